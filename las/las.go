@@ -0,0 +1,4896 @@
+package main
+
+import (
+    "bytes"
+    "context"
+    "crypto/aes"
+    "crypto/cipher"
+    "crypto/ecdsa"
+    "crypto/elliptic"
+    "crypto/hmac"
+    "crypto/rand"
+    "crypto/sha256"
+    "crypto/subtle"
+    "crypto/tls"
+    "crypto/x509"
+    "crypto/x509/pkix"
+    "encoding/base64"
+    "encoding/hex"
+    "encoding/json"
+    "encoding/pem"
+    "errors"
+    "flag"
+    "fmt"
+    "io"
+    "io/ioutil"
+    "log/slog"
+    "math/big"
+    "net"
+    "net/http"
+    "net/url"
+    "os"
+    "os/exec"
+    "os/signal"
+    "path"
+    "path/filepath"
+    "reflect"
+    "regexp"
+    "sort"
+    "strconv"
+    "strings"
+    "sync"
+    "syscall"
+    "time"
+
+    "github.com/PaloAltoNetworks/pango"
+)
+
+const (
+    DefaultConfigFile string = "/home/ec2-user/config.json"
+    DefaultBaseDir string = "/home/ec2-user"
+    RepoName string = "cloud-automation-demo"
+    DefaultAnsiblePlaybook string = "/usr/local/bin/ansible-playbook"
+    QueueSize int = 16
+    JobHistory int = 100
+    ZeroSha string = "0000000000000000000000000000000000000000"
+    StatusContext string = "las/deploy"
+    DefaultMessage string = "Performing commit"
+    MaxCommentOutput int = 60000
+    LedgerSize int = 1000
+    DefaultShutdownTimeout time.Duration = 5 * time.Minute
+    ShutdownGrace time.Duration = 30 * time.Second
+    KillDelay time.Duration = 10 * time.Second
+    DefaultListen string = ":8080"
+    SelfSignedValidity time.Duration = 5 * 365 * 24 * time.Hour
+    FirewallCheckInterval time.Duration = time.Minute
+    FirewallRetryInterval time.Duration = 10 * time.Second
+    CheckTimeout time.Duration = 30 * time.Second
+    SecretTimeout time.Duration = 30 * time.Second
+    DefaultLogFile string = "/tmp/hook.log"
+    DefaultLogMaxSize int = 10
+    DefaultLogMaxAge int = 24
+    DefaultLogKeep int = 7
+    UntrustZone string = "L3-untrust"
+    TrustZone string = "L3-trust"
+    ApplicationDefault string = "application-default"
+    ApplicationsMaxAge time.Duration = time.Hour
+    MaxPayloadSize int64 = 25 << 20
+    ReadHeaderTimeout time.Duration = 10 * time.Second
+    ReadTimeout time.Duration = time.Minute
+    WriteTimeout time.Duration = time.Minute
+    IdleTimeout time.Duration = 2 * time.Minute
+)
+
+type Ping struct {
+    Hook HookInfo `json:"hook"`
+    Zen string `json:"zen"`
+}
+
+type HookInfo struct {
+    Id int `json:"id"`
+    Name string `json:"name"`
+    PingUrl string `json:"ping_url"`
+}
+
+type PullRequestEvent struct {
+    Action string `json:"action"`
+    Number int `json:"number"`
+    PullRequest PullRequest `json:"pull_request"`
+    Repo Repository `json:"repository"`
+    Sender User `json:"sender"`
+}
+
+type PullRequest struct {
+    Head GitRef `json:"head"`
+    Base GitRef `json:"base"`
+}
+
+type GitRef struct {
+    Ref string `json:"ref"`
+    Sha string `json:"sha"`
+}
+
+type CreateEvent struct {
+    Ref string `json:"ref"`
+    RefType string `json:"ref_type"`
+    Repo Repository `json:"repository"`
+}
+
+type IssueCommentEvent struct {
+    Action string `json:"action"`
+    Issue Issue `json:"issue"`
+    Comment Comment `json:"comment"`
+    Repo Repository `json:"repository"`
+}
+
+type Issue struct {
+    Number int `json:"number"`
+}
+
+type Comment struct {
+    Body string `json:"body"`
+    User User `json:"user"`
+}
+
+type User struct {
+    Login string `json:"login"`
+}
+
+type Payload struct {
+    Ref string `json:"ref"`
+    After string `json:"after"`
+    Deleted bool `json:"deleted"`
+    Repo Repository `json:"repository"`
+    From Pusher `json:"pusher"`
+    Commit HeadCommit `json:"head_commit"`
+}
+
+// Event kinds.
+const (
+    EventPing string = "ping"
+    EventPush string = "push"
+    EventPullRequest string = "pull_request"
+)
+
+// Event is a webhook event from any provider, reduced to what las needs.  For
+// pull requests, Sha is the head commit, FetchRef is where the provider
+// publishes it and Base is the revision it would merge into.
+type Event struct {
+    Kind string
+    Provider string
+    Delivery string
+    Repo string
+    Ref string
+    Sha string
+    Deleted bool
+    DefaultBranch string
+    Pusher string
+    Message string
+    PullRequest int
+    FetchRef string
+    Base string
+}
+
+func (e *Event) IsValid(c *HookConfig) error {
+    slog.Debug("Validating payload", "delivery", e.Delivery)
+    if e.Repo != c.RepoName() {
+        return fmt.Errorf("Invalid repo name")
+    } else if e.Pusher != c.GitHubAccount {
+        return fmt.Errorf("Skipping other user commit")
+    } else if e.Message == "" {
+        return fmt.Errorf("No head commit message")
+    } else if !shaRe.MatchString(e.Sha) {
+        return fmt.Errorf("Invalid commit SHA %q", e.Sha)
+    }
+
+    return nil
+}
+
+// CanPlan returns if a pull request sent by the given user is planned.  The
+// plan renders the pull request's settings.json and runs with the firewall
+// credentials, so only the account itself and the users in plan_users are
+// trusted with it.
+func (c *HookConfig) CanPlan(user string) bool {
+    if user == "" {
+        return false
+    } else if user == c.GitHubAccount {
+        return true
+    }
+    for _, u := range c.PlanUsers {
+        if u == user {
+            return true
+        }
+    }
+    return false
+}
+
+// SkipReason returns why this push should not be deployed, or an empty
+// string if it should be.  Only refs matching the configured patterns are
+// deployed, defaulting to the repo's default branch.
+func (e *Event) SkipReason(c *HookConfig) string {
+    if e.Deleted || e.Sha == ZeroSha {
+        return fmt.Sprintf("%s was deleted", e.Ref)
+    }
+
+    refs := c.Refs
+    if len(refs) == 0 {
+        refs = []string{"refs/heads/" + e.DefaultBranch}
+    }
+    for _, pattern := range refs {
+        if ok, _ := path.Match(pattern, e.Ref); ok {
+            return ""
+        }
+    }
+
+    return fmt.Sprintf("%s does not match any allowed ref", e.Ref)
+}
+
+type Repository struct {
+    Name string `json:"full_name"`
+    DefaultBranch string `json:"default_branch"`
+    Url string `json:"html_url"`
+    Git string `json:"git_url"`
+}
+
+type Pusher struct {
+    Name string `json:"name"`
+    Login string `json:"login"`
+}
+
+type GitLabPush struct {
+    Ref string `json:"ref"`
+    After string `json:"after"`
+    CheckoutSha string `json:"checkout_sha"`
+    UserUsername string `json:"user_username"`
+    Project GitLabProject `json:"project"`
+    Commits []GitLabCommit `json:"commits"`
+}
+
+type GitLabMergeRequest struct {
+    User GitLabUser `json:"user"`
+    Project GitLabProject `json:"project"`
+    Attrs GitLabMergeRequestAttrs `json:"object_attributes"`
+}
+
+type GitLabMergeRequestAttrs struct {
+    Iid int `json:"iid"`
+    Action string `json:"action"`
+    SourceBranch string `json:"source_branch"`
+    TargetBranch string `json:"target_branch"`
+    Oldrev string `json:"oldrev"`
+    LastCommit GitLabCommit `json:"last_commit"`
+}
+
+type GitLabProject struct {
+    Name string `json:"path_with_namespace"`
+    DefaultBranch string `json:"default_branch"`
+}
+
+type GitLabCommit struct {
+    Id string `json:"id"`
+    Message string `json:"message"`
+}
+
+type GitLabUser struct {
+    Username string `json:"username"`
+}
+
+type HeadCommit struct {
+    Msg string `json:"message"`
+}
+
+type DemoConfig struct {
+    Method string `json:"exec"`
+    Addresses []DemoAddress `json:"addresses,omitempty"`
+    AddressGroups []DemoAddressGroup `json:"address_groups,omitempty"`
+    Services []DemoService `json:"apps"`
+}
+
+// DemoAddress is an address object from settings.json, with exactly one of
+// "ip_netmask", "ip_range" or "fqdn".
+type DemoAddress struct {
+    Name string `json:"name"`
+    IpNetmask string `json:"ip_netmask,omitempty"`
+    IpRange string `json:"ip_range,omitempty"`
+    Fqdn string `json:"fqdn,omitempty"`
+}
+
+// Type is the address object's type: ip-netmask, ip-range or fqdn.
+func (a DemoAddress) Type() string {
+    if a.IpRange != "" {
+        return "ip-range"
+    } else if a.Fqdn != "" {
+        return "fqdn"
+    }
+    return "ip-netmask"
+}
+
+// Value is the address object's IP, CIDR, range or FQDN.
+func (a DemoAddress) Value() string {
+    return a.IpNetmask + a.IpRange + a.Fqdn
+}
+
+// Describe summarizes the address, e.g. "ip-range 10.0.0.10-10.0.0.20".
+func (a DemoAddress) Describe() string {
+    return fmt.Sprintf("%s %s", a.Type(), a.Value())
+}
+
+// DemoAddressGroup is an address group from settings.json.  A static group
+// lists its members, which are addresses or groups listed before it; a
+// dynamic group has a tag filter such as "'web' and 'prod'".
+type DemoAddressGroup struct {
+    Name string `json:"name"`
+    Static []string `json:"static,omitempty"`
+    Dynamic string `json:"dynamic,omitempty"`
+}
+
+// Describe summarizes the group, e.g. "static group of web, db" or "dynamic
+// group matching 'web' and 'prod'".
+func (g DemoAddressGroup) Describe() string {
+    if len(g.Static) != 0 {
+        return "static group of " + strings.Join(g.Static, ", ")
+    }
+    return "dynamic group matching " + g.Dynamic
+}
+
+// UsedBy returns the apps whose rules match the named address or group,
+// directly or through static groups.
+func (dc DemoConfig) UsedBy(name string) []string {
+    names := map[string]bool{name: true}
+    for _, g := range dc.AddressGroups {
+        for _, m := range g.Static {
+            if names[m] {
+                names[g.Name] = true
+            }
+        }
+    }
+
+    ans := make([]string, 0)
+    for _, s := range dc.Services {
+        for _, a := range append(append([]string{}, s.SourceAddresses...), s.DestinationAddresses...) {
+            if names[a] {
+                ans = append(ans, s.Name)
+                break
+            }
+        }
+    }
+    return ans
+}
+
+func (dc DemoConfig) IsValid() error {
+    if dc.Method == "" {
+        return fmt.Errorf("Missing \"exec\"")
+    } else if dc.Method != "ansible" && dc.Method != "terraform" {
+        return fmt.Errorf("Invalid \"exec\" specified; only 'ansible' or 'terraform' allowed")
+    } else if len(dc.Services) == 0 {
+        return fmt.Errorf("No \"apps\" block found")
+    } else if err := dc.checkAddresses(); err != nil {
+        return err
+    }
+
+    names := make(map[string]int, len(dc.Services))
+    objects := make(map[string]int, len(dc.Services))
+    for i, v := range dc.Services {
+        if v.Name == "" {
+            return appError(i, v, "name", "no name specified")
+        } else if !appNameRe.MatchString(v.Name) {
+            return appError(i, v, "name", "not a valid name; names are up to 57 letters, digits, spaces, '.', '_' or '-', starting with a letter or digit")
+        } else if j, ok := names[v.Name]; ok {
+            return appError(i, v, "name", "apps[%d] has the same name", j)
+        } else if v.Protocol != "" && v.Protocol != "tcp" && v.Protocol != "udp" && v.Protocol != "both" {
+            return appError(i, v, "protocol", "invalid protocol %q; only 'tcp', 'udp' or 'both' allowed", v.Protocol)
+        } else if len(v.Ports) != 0 && (len(v.TcpPorts) != 0 || len(v.UdpPorts) != 0) {
+            return appError(i, v, "", "give either \"ports\" or \"tcp_ports\" and \"udp_ports\", not both")
+        } else if v.Protocol != "" && len(v.Ports) == 0 {
+            return appError(i, v, "protocol", "\"protocol\" only applies to \"ports\"")
+        } else if v.Service != "" && v.Service != "custom" && v.Service != ApplicationDefault {
+            return appError(i, v, "service", "invalid service %q; only 'custom' or '%s' allowed", v.Service, ApplicationDefault)
+        }
+        names[v.Name] = i
+
+        // With application-default, the applications decide the ports.
+        // Otherwise there must be destination ports; source ports alone
+        // don't make a service.
+        hasPorts := len(v.Ports) != 0 || len(v.TcpPorts) != 0 || len(v.UdpPorts) != 0
+        if v.Service == ApplicationDefault {
+            if hasPorts || len(v.SourcePorts) != 0 {
+                return appError(i, v, "service", "ports can't be given with %s", ApplicationDefault)
+            } else if len(v.Applications) == 0 || v.Applications[0] == "any" {
+                return appError(i, v, "applications", "%s needs the applications to be listed", ApplicationDefault)
+            }
+        } else if !hasPorts {
+            return appError(i, v, "", "no ports specified")
+        }
+        for j, a := range v.Applications {
+            if a == "any" && len(v.Applications) > 1 {
+                return appError(i, v, fmt.Sprintf("applications[%d]", j), "\"any\" can't be listed with other applications")
+            } else if !objectNameRe.MatchString(a) {
+                return appError(i, v, fmt.Sprintf("applications[%d]", j), "%q is not a valid application name", a)
+            }
+        }
+
+        lists := []struct {
+            key string
+            specs []PortSpec
+        }{
+            {"ports", v.Ports},
+            {"tcp_ports", v.TcpPorts},
+            {"udp_ports", v.UdpPorts},
+            {"source_ports", v.SourcePorts},
+        }
+        for _, l := range lists {
+            seen := make(map[PortRange]int, len(l.specs))
+            for j, p := range l.specs {
+                r, err := p.Parse()
+                if err != nil {
+                    return appError(i, v, fmt.Sprintf("%s[%d]", l.key, j), "%s", err)
+                } else if k, ok := seen[r]; ok {
+                    return appError(i, v, fmt.Sprintf("%s[%d]", l.key, j), "%s is already given as %s[%d]", r, l.key, k)
+                }
+                seen[r] = j
+            }
+        }
+
+        zones := []struct {
+            key string
+            zones []string
+        }{
+            {"source_zones", v.SourceZones},
+            {"destination_zones", v.DestinationZones},
+        }
+        for _, l := range zones {
+            for j, z := range l.zones {
+                if !zoneRe.MatchString(z) {
+                    return appError(i, v, fmt.Sprintf("%s[%d]", l.key, j), "%q is not a valid zone name", z)
+                }
+            }
+        }
+
+        addrs := []struct {
+            key string
+            addrs []string
+            negate bool
+        }{
+            {"source_addresses", v.SourceAddresses, v.NegateSource},
+            {"destination_addresses", v.DestinationAddresses, v.NegateDestination},
+        }
+        for _, l := range addrs {
+            for j, a := range l.addrs {
+                if err := checkAddress(a); err != nil {
+                    return appError(i, v, fmt.Sprintf("%s[%d]", l.key, j), "%s", err)
+                } else if a == "any" && len(l.addrs) > 1 {
+                    return appError(i, v, fmt.Sprintf("%s[%d]", l.key, j), "\"any\" can't be listed with other addresses")
+                }
+            }
+            if l.negate && (len(l.addrs) == 0 || l.addrs[0] == "any") {
+                return appError(i, v, "negate_" + strings.TrimSuffix(l.key, "_addresses"), "only addresses other than \"any\" can be negated")
+            }
+        }
+
+        // The service objects and groups of different apps can't share names,
+        // such as those of an app "dns" using both protocols and an app
+        // "dns-tcp".
+        for _, o := range v.ObjectNames() {
+            if j, ok := objects[o]; ok {
+                return appError(i, v, "name", "service %q would have the same name as one of apps[%d]'s", o, j)
+            }
+            objects[o] = i
+        }
+    }
+
+    return nil
+}
+
+// checkAddresses checks the address objects and groups, which share names.
+func (dc DemoConfig) checkAddresses() error {
+    names := make(map[string]string, len(dc.Addresses) + len(dc.AddressGroups))
+
+    for i, a := range dc.Addresses {
+        path := fmt.Sprintf("addresses[%d]", i)
+        if err := checkObjectName(a.Name); err != nil {
+            return addressError("Address", path, a.Name, "name", "%s", err)
+        } else if p, ok := names[a.Name]; ok {
+            return addressError("Address", path, a.Name, "name", "%s has the same name", p)
+        }
+        names[a.Name] = path
+
+        given := 0
+        for _, v := range []string{a.IpNetmask, a.IpRange, a.Fqdn} {
+            if v != "" {
+                given++
+            }
+        }
+        if given != 1 {
+            return addressError("Address", path, a.Name, "", "give one of \"ip_netmask\", \"ip_range\" or \"fqdn\"")
+        }
+
+        switch a.Type() {
+        case "ip-netmask":
+            if _, _, err := net.ParseCIDR(a.IpNetmask); err != nil && net.ParseIP(a.IpNetmask) == nil {
+                return addressError("Address", path, a.Name, "ip_netmask", "%q is not a valid IP address or CIDR", a.IpNetmask)
+            }
+        case "ip-range":
+            if err := checkIpRange(a.IpRange); err != nil {
+                return addressError("Address", path, a.Name, "ip_range", "%s", err)
+            }
+        case "fqdn":
+            if len(a.Fqdn) > 255 || !fqdnRe.MatchString(a.Fqdn) {
+                return addressError("Address", path, a.Name, "fqdn", "%q is not a valid FQDN", a.Fqdn)
+            }
+        }
+    }
+
+    for i, g := range dc.AddressGroups {
+        path := fmt.Sprintf("address_groups[%d]", i)
+        if err := checkObjectName(g.Name); err != nil {
+            return addressError("Address group", path, g.Name, "name", "%s", err)
+        } else if p, ok := names[g.Name]; ok {
+            return addressError("Address group", path, g.Name, "name", "%s has the same name", p)
+        } else if (len(g.Static) == 0) == (g.Dynamic == "") {
+            return addressError("Address group", path, g.Name, "", "give either \"static\" or \"dynamic\"")
+        } else if g.Dynamic != "" && (len(g.Dynamic) > 2047 || !dynamicFilterRe.MatchString(g.Dynamic)) {
+            return addressError("Address group", path, g.Name, "dynamic", "%q is not a valid tag filter", g.Dynamic)
+        }
+
+        seen := make(map[string]int, len(g.Static))
+        for j, m := range g.Static {
+            key := fmt.Sprintf("static[%d]", j)
+            if _, ok := names[m]; !ok {
+                return addressError("Address group", path, g.Name, key, "%q is not an address or an address group listed before this one", m)
+            } else if k, ok := seen[m]; ok {
+                return addressError("Address group", path, g.Name, key, "%q is already given as static[%d]", m, k)
+            }
+            seen[m] = j
+        }
+        names[g.Name] = path
+    }
+
+    return nil
+}
+
+// checkObjectName checks the name of an address or address group, which
+// mustn't be mistaken for an address where apps refer to it.
+func checkObjectName(name string) error {
+    if name == "" {
+        return fmt.Errorf("no name specified")
+    } else if name == "any" || ipLikeRe.MatchString(name) {
+        return fmt.Errorf("%q looks like an address rather than a name", name)
+    } else if !objectNameRe.MatchString(name) {
+        return fmt.Errorf("%q is not a valid object name", name)
+    }
+    return nil
+}
+
+// checkIpRange checks a range of addresses such as "10.0.0.10-10.0.0.20".
+func checkIpRange(r string) error {
+    lo, hi, ok := strings.Cut(r, "-")
+    if !ok {
+        return fmt.Errorf("%q is not a range such as 10.0.0.10-10.0.0.20", r)
+    }
+
+    a, b := net.ParseIP(lo), net.ParseIP(hi)
+    if a == nil || b == nil || (a.To4() == nil) != (b.To4() == nil) {
+        return fmt.Errorf("%q is not a range of IPv4 or IPv6 addresses", r)
+    } else if bytes.Compare(a.To16(), b.To16()) > 0 {
+        return fmt.Errorf("%q ends before it starts", r)
+    }
+    return nil
+}
+
+// addressError describes a problem with an address or address group in
+// settings.json, like appError does for apps.
+func addressError(kind, path, name, key, format string, args ...interface{}) error {
+    if key != "" {
+        path += "." + key
+    }
+
+    msg := fmt.Sprintf(format, args...)
+    if name == "" {
+        return fmt.Errorf("%s: %s", path, msg)
+    }
+    return fmt.Errorf("%s %q (%s): %s", kind, name, path, msg)
+}
+
+// checkAddress checks an address from settings.json, which is "any", an IP
+// address or CIDR, or the name of an address object.
+func checkAddress(a string) error {
+    if a == "any" {
+        return nil
+    } else if ipLikeRe.MatchString(a) || strings.Contains(a, ":") {
+        if _, _, err := net.ParseCIDR(a); err == nil {
+            return nil
+        } else if net.ParseIP(a) != nil {
+            return nil
+        }
+        return fmt.Errorf("%q is not a valid IP address or CIDR", a)
+    } else if !objectNameRe.MatchString(a) {
+        return fmt.Errorf("%q is not a valid address object name", a)
+    }
+    return nil
+}
+
+// CheckApplications checks that the apps only use the firewall's predefined
+// applications, or "any".  Custom applications and application groups aren't
+// among them.
+func (dc DemoConfig) CheckApplications(known map[string]bool) error {
+    for i, v := range dc.Services {
+        for j, a := range v.Applications {
+            if a != "any" && !known[a] {
+                return appError(i, v, fmt.Sprintf("applications[%d]", j), "%q is not one of the firewall's predefined applications", a)
+            }
+        }
+    }
+    return nil
+}
+
+// appError describes a problem with an app in settings.json, naming the app
+// and the JSON path of what's wrong so the pusher can find it.
+func appError(i int, s DemoService, key, format string, args ...interface{}) error {
+    path := fmt.Sprintf("apps[%d]", i)
+    if key != "" {
+        path += "." + key
+    }
+
+    msg := fmt.Sprintf(format, args...)
+    if s.Name == "" {
+        return fmt.Errorf("%s: %s", path, msg)
+    }
+    return fmt.Errorf("App %q (%s): %s", s.Name, path, msg)
+}
+
+// PortSpec is a port or port range from settings.json, given as either a
+// number or a string such as "443" or "8000-8100".  It's checked by Parse
+// rather than when it's decoded, so that IsValid can say where it is.
+type PortSpec string
+
+func (p *PortSpec) UnmarshalJSON(b []byte) error {
+    var s string
+    if err := json.Unmarshal(b, &s); err != nil {
+        s = string(b)
+    }
+    *p = PortSpec(s)
+    return nil
+}
+
+// Parse returns the port range the spec describes.
+func (p PortSpec) Parse() (PortRange, error) {
+    lo, hi, isRange := strings.Cut(string(p), "-")
+    if !isRange {
+        hi = lo
+    }
+
+    a, aerr := strconv.Atoi(strings.TrimSpace(lo))
+    b, berr := strconv.Atoi(strings.TrimSpace(hi))
+    r := PortRange{a, b}
+    if aerr != nil || berr != nil {
+        return r, fmt.Errorf("%q is not a port or port range", string(p))
+    } else if a < 1 || a > 65535 || b < 1 || b > 65535 {
+        return r, fmt.Errorf("%s is outside of 1-65535", r)
+    } else if a > b {
+        return r, fmt.Errorf("%s is backwards; the lower port comes first", string(p))
+    }
+    return r, nil
+}
+
+// PortRange is an inclusive range of ports.
+type PortRange struct {
+    Lo int
+    Hi int
+}
+
+func (r PortRange) String() string {
+    if r.Lo == r.Hi {
+        return strconv.Itoa(r.Lo)
+    }
+    return fmt.Sprintf("%d-%d", r.Lo, r.Hi)
+}
+
+// mergePorts sorts port specs and merges those that overlap or are next to
+// each other, returning them as the firewall takes them, e.g. "80,8000-8100".
+// Invalid specs are left out; IsValid reports them.
+func mergePorts(specs []PortSpec) string {
+    ranges := make([]PortRange, 0, len(specs))
+    for _, p := range specs {
+        if r, err := p.Parse(); err == nil {
+            ranges = append(ranges, r)
+        }
+    }
+    sort.Slice(ranges, func(i, j int) bool {
+        return ranges[i].Lo < ranges[j].Lo
+    })
+
+    ans := make([]string, 0, len(ranges))
+    for i := 0; i < len(ranges); {
+        r := ranges[i]
+        for i++; i < len(ranges) && ranges[i].Lo <= r.Hi + 1; i++ {
+            if ranges[i].Hi > r.Hi {
+                r.Hi = ranges[i].Hi
+            }
+        }
+        ans = append(ans, r.String())
+    }
+    return strings.Join(ans, ",")
+}
+
+// DemoService is an app from settings.json.  Its ports are either "ports",
+// with a "protocol" of "tcp" (the default), "udp" or "both", or separate
+// "tcp_ports" and "udp_ports".  Its "source_ports", if any, apply to all of
+// them.  If its "service" is application-default rather than "custom", it
+// has no ports, and its rule allows its applications on their standard
+// ports.
+type DemoService struct {
+    Name string `json:"name"`
+    Service string `json:"service,omitempty"`
+    Applications []string `json:"applications,omitempty"`
+    Protocol string `json:"protocol,omitempty"`
+    Ports []PortSpec `json:"ports,omitempty"`
+    TcpPorts []PortSpec `json:"tcp_ports,omitempty"`
+    UdpPorts []PortSpec `json:"udp_ports,omitempty"`
+    SourcePorts []PortSpec `json:"source_ports,omitempty"`
+    SourceZones []string `json:"source_zones,omitempty"`
+    SourceAddresses []string `json:"source_addresses,omitempty"`
+    NegateSource bool `json:"negate_source,omitempty"`
+    DestinationZones []string `json:"destination_zones,omitempty"`
+    DestinationAddresses []string `json:"destination_addresses,omitempty"`
+    NegateDestination bool `json:"negate_destination,omitempty"`
+}
+
+// ServiceName is the service the app's security rule allows: its service
+// object or group, or application-default.
+func (s DemoService) ServiceName() string {
+    if s.Service == ApplicationDefault {
+        return ApplicationDefault
+    }
+    return s.Name
+}
+
+// Rule returns what the app's security rule matches, with the defaults for
+// what the app leaves out: from the untrust zone to the trust zone, for any
+// address, and any application.
+func (s DemoService) Rule() SecurityRule {
+    r := SecurityRule{
+        Applications: s.Applications,
+        SourceZones: s.SourceZones,
+        SourceAddresses: s.SourceAddresses,
+        NegateSource: s.NegateSource,
+        DestinationZones: s.DestinationZones,
+        DestinationAddresses: s.DestinationAddresses,
+        NegateDestination: s.NegateDestination,
+    }
+    if len(r.SourceZones) == 0 {
+        r.SourceZones = []string{UntrustZone}
+    }
+    if len(r.SourceAddresses) == 0 {
+        r.SourceAddresses = []string{"any"}
+    }
+    if len(r.DestinationZones) == 0 {
+        r.DestinationZones = []string{TrustZone}
+    }
+    if len(r.DestinationAddresses) == 0 {
+        r.DestinationAddresses = []string{"any"}
+    }
+    if len(r.Applications) == 0 {
+        r.Applications = []string{"any"}
+    }
+    return r
+}
+
+// SecurityRule is what an app's security rule matches.
+type SecurityRule struct {
+    Applications []string
+    SourceZones []string
+    SourceAddresses []string
+    NegateSource bool
+    DestinationZones []string
+    DestinationAddresses []string
+    NegateDestination bool
+}
+
+// Describe summarizes the rule, e.g. "ssl from L3-untrust (any) to L3-trust
+// (not 10.0.0.0/8)".
+func (r SecurityRule) Describe() string {
+    side := func(zones, addrs []string, negate bool) string {
+        a := strings.Join(addrs, ", ")
+        if negate {
+            a = "not " + a
+        }
+        return fmt.Sprintf("%s (%s)", strings.Join(zones, ", "), a)
+    }
+    return fmt.Sprintf("%s from %s to %s", strings.Join(r.Applications, ", "), side(r.SourceZones, r.SourceAddresses, r.NegateSource), side(r.DestinationZones, r.DestinationAddresses, r.NegateDestination))
+}
+
+// ServiceObject is a firewall service object for an app.
+type ServiceObject struct {
+    Name string
+    Protocol string
+    Ports string
+    SourcePorts string
+}
+
+// PortsFor returns the app's ports for a protocol.
+func (s DemoService) PortsFor(protocol string) []PortSpec {
+    if len(s.Ports) != 0 {
+        if s.Protocol == protocol || s.Protocol == "both" || (s.Protocol == "" && protocol == "tcp") {
+            return s.Ports
+        }
+        return nil
+    } else if protocol == "udp" {
+        return s.UdpPorts
+    }
+    return s.TcpPorts
+}
+
+// Objects returns the app's service objects, one per protocol it uses.  An
+// app with only one protocol has a service object named after it.  An app
+// with both has a service object for each, named "<app>-tcp" and "<app>-udp",
+// and IsGroup is true: they're joined in a service group named after it.
+func (s DemoService) Objects() []ServiceObject {
+    ans := make([]ServiceObject, 0, 2)
+    if s.Service == ApplicationDefault {
+        return ans
+    }
+    for _, protocol := range []string{"tcp", "udp"} {
+        if ports := s.PortsFor(protocol); len(ports) != 0 {
+            ans = append(ans, ServiceObject{
+                Name: s.Name,
+                Protocol: protocol,
+                Ports: mergePorts(ports),
+                SourcePorts: mergePorts(s.SourcePorts),
+            })
+        }
+    }
+
+    if len(ans) > 1 {
+        for i := range ans {
+            ans[i].Name = fmt.Sprintf("%s-%s", s.Name, ans[i].Protocol)
+        }
+    }
+    return ans
+}
+
+// ObjectNames returns the names of the app's service objects and group.
+func (s DemoService) ObjectNames() []string {
+    objs := s.Objects()
+    ans := make([]string, 0, len(objs) + 1)
+    for _, o := range objs {
+        ans = append(ans, o.Name)
+    }
+    if len(objs) > 1 {
+        ans = append(ans, s.Name)
+    }
+    return ans
+}
+
+// IsGroup returns if the app's service objects are joined in a service group.
+func (s DemoService) IsGroup() bool {
+    return len(s.Objects()) > 1
+}
+
+// Describe summarizes the service's ports, e.g. "tcp/80,443 udp/443".
+func (s DemoService) Describe() string {
+    if s.Service == ApplicationDefault {
+        return ApplicationDefault
+    }
+
+    objs := s.Objects()
+    ans := make([]string, len(objs))
+    for i, o := range objs {
+        ans[i] = fmt.Sprintf("%s/%s", o.Protocol, o.Ports)
+    }
+    if len(s.SourcePorts) != 0 {
+        return fmt.Sprintf("%s from ports %s", strings.Join(ans, " "), mergePorts(s.SourcePorts))
+    }
+    return strings.Join(ans, " ")
+}
+
+// Deployment pipeline stages.
+const (
+    StagePull string = "pull"
+    StageRender string = "render"
+    StageInit string = "init"
+    StagePlan string = "plan"
+    StageApply string = "apply"
+    StageCommit string = "commit"
+)
+
+// Job kinds.
+const (
+    KindDeploy string = "deploy"
+    KindPlan string = "plan"
+)
+
+// Job states.
+const (
+    JobQueued string = "queued"
+    JobRunning string = "running"
+    JobSucceeded string = "succeeded"
+    JobFailed string = "failed"
+    JobSkipped string = "skipped"
+    JobCancelled string = "cancelled"
+)
+
+// JobStatus is the externally visible state of a job.
+type JobStatus struct {
+    Id string `json:"id"`
+    Kind string `json:"kind"`
+    Tenant string `json:"tenant"`
+    Provider string `json:"provider"`
+    Delivery string `json:"delivery"`
+    Repo string `json:"repo"`
+    Ref string `json:"ref,omitempty"`
+    PullRequest int `json:"pull_request,omitempty"`
+    Sha string `json:"sha"`
+    Pusher string `json:"pusher"`
+    Method string `json:"exec,omitempty"`
+    State string `json:"state"`
+    Stage string `json:"stage,omitempty"`
+    Created time.Time `json:"created"`
+    Started *time.Time `json:"started,omitempty"`
+    Ended *time.Time `json:"ended,omitempty"`
+    ExitCode int `json:"exit_code"`
+    Error string `json:"error,omitempty"`
+    Reason string `json:"reason,omitempty"`
+    LogFile string `json:"log_file,omitempty"`
+    Output string `json:"output,omitempty"`
+}
+
+// Finished returns if the job is done, one way or another.
+func (s JobStatus) Finished() bool {
+    return s.State != JobQueued && s.State != JobRunning
+}
+
+// Job is a single run of the deployment pipeline: either a deployment of a
+// push, or a plan-only preview of a pull request.
+type Job struct {
+    mu sync.Mutex
+    JobStatus
+    tenant *Tenant
+    dir string
+    Message string
+    FetchRef string
+    Base string
+    output bytes.Buffer
+    stageStart int
+    stageBegan time.Time
+    logFile *os.File
+    cmd *exec.Cmd
+    interrupted bool
+    cancelled bool
+    ctx context.Context
+    cancel context.CancelFunc
+}
+
+// NewJob returns a job of the given kind for a tenant's event, with a random
+// ID.
+func NewJob(t *Tenant, kind string, ev *Event) *Job {
+    id := make([]byte, 8)
+    rand.Read(id)
+
+    return &Job{
+        tenant: t,
+        JobStatus: JobStatus{
+            Id: hex.EncodeToString(id),
+            Kind: kind,
+            Tenant: t.Name,
+            Provider: ev.Provider,
+            Delivery: ev.Delivery,
+            Repo: ev.Repo,
+            Ref: ev.Ref,
+            PullRequest: ev.PullRequest,
+            Sha: ev.Sha,
+            Pusher: ev.Pusher,
+            State: JobQueued,
+            Created: time.Now(),
+        },
+        Message: ev.Message,
+        FetchRef: ev.FetchRef,
+        Base: ev.Base,
+    }
+}
+
+// Write captures subprocess output for this job, both in memory and in the
+// job's log file.
+func (j *Job) Write(p []byte) (int, error) {
+    j.mu.Lock()
+    defer j.mu.Unlock()
+    if j.logFile != nil {
+        if _, err := j.logFile.Write(p); err != nil {
+            j.logger().Warn("Failed to write job log", "err", err)
+            j.logFile.Close()
+            j.logFile = nil
+        }
+    }
+    return j.output.Write(p)
+}
+
+// Log returns a logger that tags entries with the job's IDs and its current
+// stage.
+func (j *Job) Log() *slog.Logger {
+    j.mu.Lock()
+    defer j.mu.Unlock()
+    return j.logger()
+}
+
+// logger is Log for callers that hold the job's lock.
+func (j *Job) logger() *slog.Logger {
+    l := slog.With("job", j.Id, "tenant", j.Tenant, "kind", j.Kind, "delivery", j.Delivery, "sha", j.Sha)
+    if j.Stage != "" {
+        l = l.With("stage", j.Stage)
+    }
+    return l
+}
+
+// Status returns a copy of the job's status, optionally including the
+// captured subprocess output.
+func (j *Job) Status(withOutput bool) JobStatus {
+    j.mu.Lock()
+    defer j.mu.Unlock()
+
+    s := j.JobStatus
+    if withOutput {
+        s.Output = j.output.String()
+    }
+    return s
+}
+
+// SetStage records the pipeline stage the job is in.
+func (j *Job) SetStage(stage string) {
+    now := time.Now()
+    j.mu.Lock()
+    if j.Stage != stage {
+        j.observeStage(now)
+        j.Stage = stage
+        j.stageStart = j.output.Len()
+        j.stageBegan = now
+    }
+    j.mu.Unlock()
+}
+
+// observeStage records how long the job's current stage took.  The caller
+// must hold the job's lock.
+func (j *Job) observeStage(now time.Time) {
+    if j.Stage != "" && !j.stageBegan.IsZero() {
+        metrics.ObserveStage(j.Stage, j.Method, now.Sub(j.stageBegan))
+    }
+}
+
+// StageOutput returns the subprocess output captured since the job entered
+// its current stage.
+func (j *Job) StageOutput() string {
+    j.mu.Lock()
+    defer j.mu.Unlock()
+    return string(j.output.Bytes()[j.stageStart:])
+}
+
+// Config returns the config of the job's tenant.
+func (j *Job) Config() *HookConfig {
+    return &j.tenant.Config
+}
+
+// SetDir sets the working directory of the job's subprocesses.
+func (j *Job) SetDir(dir string) {
+    j.mu.Lock()
+    j.dir = dir
+    j.mu.Unlock()
+}
+
+// SetMethod records the exec method from the demo config.
+func (j *Job) SetMethod(method string) {
+    j.mu.Lock()
+    j.Method = method
+    j.mu.Unlock()
+}
+
+// Start marks the job as running and opens its log file in dir.
+func (j *Job) Start(dir string) {
+    now := time.Now()
+    j.mu.Lock()
+    j.State = JobRunning
+    j.Started = &now
+    name := filepath.Join(dir, j.Id+".log")
+    fd, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0640)
+    if err != nil {
+        j.logger().Warn("Failed to open job log", "err", err)
+    } else {
+        j.logFile = fd
+        j.LogFile = name
+    }
+    j.ctx, j.cancel = context.WithCancel(context.Background())
+    if j.cancelled {
+        j.cancel()
+    }
+    j.mu.Unlock()
+}
+
+// Finish marks the job as done, failed if err is non-nil.
+func (j *Job) Finish(err error) {
+    now := time.Now()
+    j.mu.Lock()
+    defer j.mu.Unlock()
+    j.Ended = &now
+    j.observeStage(now)
+    if j.cancel != nil {
+        j.cancel()
+    }
+    if j.logFile != nil {
+        j.logFile.Close()
+        j.logFile = nil
+    }
+    if j.cancelled {
+        j.State = JobCancelled
+        if j.Stage == "" {
+            j.Error = "Cancelled before it started"
+        } else {
+            j.Error = fmt.Sprintf("Cancelled during %s stage", j.Stage)
+        }
+        if err != nil {
+            j.Error += ": " + err.Error()
+        }
+    } else if err != nil {
+        j.State = JobFailed
+        j.Error = err.Error()
+    } else {
+        j.State = JobSucceeded
+    }
+}
+
+// Cancel stops the job: a queued job won't be started, and a running job's
+// subprocess is killed.
+func (j *Job) Cancel() error {
+    j.mu.Lock()
+    defer j.mu.Unlock()
+
+    if j.State != JobQueued && j.State != JobRunning {
+        return fmt.Errorf("Job is already %s", j.State)
+    }
+    if !j.cancelled {
+        j.logger().Info("Cancelling job")
+    }
+    j.cancelled = true
+    if j.cancel != nil {
+        j.cancel()
+    }
+    return nil
+}
+
+// Cancelled returns if the job was cancelled.
+func (j *Job) Cancelled() bool {
+    j.mu.Lock()
+    defer j.mu.Unlock()
+    return j.cancelled
+}
+
+// Skip marks the job as acknowledged but not deployed.
+func (j *Job) Skip(reason string) {
+    now := time.Now()
+    j.mu.Lock()
+    j.State = JobSkipped
+    j.Reason = reason
+    j.Ended = &now
+    j.mu.Unlock()
+}
+
+// Run executes a subprocess as part of the given stage, subject to the
+// stage's timeout.  Output is captured on the job and in its log file.
+func (j *Job) Run(stage, name string, args ...string) error {
+    j.SetStage(stage)
+
+    timeout := stageTimeout(stage)
+    ctx, cancel := context.WithTimeout(j.ctx, timeout)
+    defer cancel()
+
+    cmd := command(ctx, name, args...)
+    cmd.Stdout, cmd.Stderr = j, j
+    cmd.Env = j.env(stage)
+
+    // Don't start anything new once the job has been interrupted.
+    j.mu.Lock()
+    cmd.Dir = j.dir
+    if j.interrupted {
+        j.mu.Unlock()
+        return fmt.Errorf("Job was interrupted")
+    }
+    err := cmd.Start()
+    j.cmd = cmd
+    j.mu.Unlock()
+    if err == nil {
+        err = cmd.Wait()
+    }
+    if err != nil && ctx.Err() == context.DeadlineExceeded && j.ctx.Err() == nil {
+        err = fmt.Errorf("%s timed out after %s", filepath.Base(name), timeout)
+    }
+
+    j.mu.Lock()
+    j.cmd = nil
+    if cmd.ProcessState != nil {
+        j.ExitCode = cmd.ProcessState.ExitCode()
+    } else {
+        j.ExitCode = -1
+    }
+    j.logger().Info("Command finished", "cmd", filepath.Base(name), "exit_code", j.ExitCode)
+    j.mu.Unlock()
+
+    return err
+}
+
+// env is the environment for one of the job's subprocesses.  Only the stages
+// that talk to the firewall get the tenant's credentials, and only for as
+// long as that subprocess runs.
+func (j *Job) env(stage string) []string {
+    env := baseEnv()
+    if CredentialStages[stage] {
+        c := j.Config()
+        env = append(env,
+            "PANOS_HOSTNAME="+c.Hostname,
+            "PANOS_USERNAME="+c.Username,
+            "PANOS_PASSWORD="+c.Password,
+        )
+    }
+    return env
+}
+
+// Interrupt sends SIGINT to the job's running subprocess, if any, giving it
+// the chance to stop cleanly.  No further subprocesses are started.
+func (j *Job) Interrupt() {
+    j.mu.Lock()
+    defer j.mu.Unlock()
+
+    j.interrupted = true
+    if j.cmd != nil && j.cmd.Process != nil {
+        j.logger().Info("Interrupting job")
+        syscall.Kill(-j.cmd.Process.Pid, syscall.SIGINT)
+    }
+}
+
+// command returns a command that runs in its own process group, so that
+// cancelling ctx kills the command along with anything it started.
+func command(ctx context.Context, name string, args ...string) *exec.Cmd {
+    cmd := exec.CommandContext(ctx, name, args...)
+    cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+    cmd.Cancel = func() error {
+        return syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+    }
+    cmd.WaitDelay = KillDelay
+    cmd.Env = baseEnv()
+    return cmd
+}
+
+// baseEnv is las's environment without any firewall credentials it was
+// started with, so that subprocesses only get the credentials meant for them.
+func baseEnv() []string {
+    env := os.Environ()
+    ans := make([]string, 0, len(env))
+    for _, v := range env {
+        if !strings.HasPrefix(v, "PANOS_") {
+            ans = append(ans, v)
+        }
+    }
+    return ans
+}
+
+// stageTimeout returns how long subprocesses in a stage may run.
+func stageTimeout(stage string) time.Duration {
+    if n := config.StageTimeouts[stage]; n > 0 {
+        return time.Duration(n) * time.Second
+    }
+    return DefaultStageTimeouts[stage]
+}
+
+// SavedJob is a queued job as persisted across restarts.
+type SavedJob struct {
+    JobStatus
+    Message string `json:"message"`
+    FetchRef string `json:"fetch_ref,omitempty"`
+    Base string `json:"base,omitempty"`
+}
+
+// SaveJobs persists the given queued jobs to path.
+func SaveJobs(path string, list []*Job) error {
+    saved := make([]SavedJob, 0, len(list))
+    for _, job := range list {
+        saved = append(saved, SavedJob{
+            JobStatus: job.Status(false),
+            Message: job.Message,
+            FetchRef: job.FetchRef,
+            Base: job.Base,
+        })
+    }
+
+    body, err := json.Marshal(saved)
+    if err != nil {
+        return err
+    }
+    return ioutil.WriteFile(path, body, 0600)
+}
+
+// LoadJobs reads the tenant's jobs persisted by SaveJobs and removes the
+// file, so they are only loaded once.
+func LoadJobs(t *Tenant, path string) ([]*Job, error) {
+    body, err := ioutil.ReadFile(path)
+    if os.IsNotExist(err) {
+        return nil, nil
+    } else if err != nil {
+        return nil, err
+    }
+    os.Remove(path)
+
+    saved := []SavedJob{}
+    if err = json.Unmarshal(body, &saved); err != nil {
+        return nil, err
+    }
+
+    ans := make([]*Job, 0, len(saved))
+    for _, sj := range saved {
+        ans = append(ans, &Job{
+            tenant: t,
+            JobStatus: sj.JobStatus,
+            Message: sj.Message,
+            FetchRef: sj.FetchRef,
+            Base: sj.Base,
+        })
+    }
+    return ans, nil
+}
+
+// JobStore keeps the most recent jobs for the status API.
+type JobStore struct {
+    mu sync.Mutex
+    jobs map[string]*Job
+    order []string
+    max int
+}
+
+// NewJobStore returns a store that remembers up to max jobs.
+func NewJobStore(max int) *JobStore {
+    return &JobStore{jobs: make(map[string]*Job), max: max}
+}
+
+// Add saves a job, forgetting the oldest finished one if the store is full.
+// Queued and running jobs are kept however many there are, so they can still
+// be watched and cancelled.
+func (s *JobStore) Add(job *Job) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    s.jobs[job.Id] = job
+    s.order = append(s.order, job.Id)
+    for i := 0; len(s.order) > s.max && i < len(s.order); i++ {
+        old := s.jobs[s.order[i]].Status(false)
+        if !old.Finished() {
+            continue
+        }
+        if old.LogFile != "" {
+            os.Remove(old.LogFile)
+        }
+        delete(s.jobs, old.Id)
+        s.order = append(s.order[:i], s.order[i+1:]...)
+        i--
+    }
+}
+
+// Get returns the job with the given ID, or nil.
+func (s *JobStore) Get(id string) *Job {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    return s.jobs[id]
+}
+
+// List returns all known jobs, newest first.
+func (s *JobStore) List() []*Job {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    ans := make([]*Job, 0, len(s.order))
+    for i := len(s.order) - 1; i >= 0; i-- {
+        ans = append(ans, s.jobs[s.order[i]])
+    }
+    return ans
+}
+
+// Ledger remembers which deliveries and commits have already been handled so
+// that redelivered webhooks don't trigger another deployment.  It is saved to
+// disk after every change.
+type Ledger struct {
+    mu sync.Mutex
+    path string
+    Deliveries []string `json:"deliveries"`
+    Deployed []string `json:"deployed"`
+}
+
+// LoadLedger reads the ledger saved at path, starting an empty one if there is
+// no ledger yet.
+func LoadLedger(path string) (*Ledger, error) {
+    l := &Ledger{path: path}
+
+    body, err := ioutil.ReadFile(path)
+    if os.IsNotExist(err) {
+        return l, nil
+    } else if err != nil {
+        return l, fmt.Errorf("Failed to read ledger: %s", err)
+    }
+    if err = json.Unmarshal(body, l); err != nil {
+        return l, fmt.Errorf("Failed to parse ledger: %s", err)
+    }
+
+    return l, nil
+}
+
+// HasDelivery returns if the given delivery was already handled.
+func (l *Ledger) HasDelivery(id string) bool {
+    l.mu.Lock()
+    defer l.mu.Unlock()
+    return id != "" && contains(l.Deliveries, id)
+}
+
+// AddDelivery records a delivery as handled.
+func (l *Ledger) AddDelivery(id string) {
+    if id == "" {
+        return
+    }
+
+    l.mu.Lock()
+    defer l.mu.Unlock()
+    l.Deliveries = appendBounded(l.Deliveries, id, LedgerSize)
+    l.save()
+}
+
+// IsDeployed returns if the given commit is the one last deployed
+// successfully.  Earlier commits aren't, so that pushing one again, such as to
+// roll back, deploys it again.
+func (l *Ledger) IsDeployed(sha string) bool {
+    l.mu.Lock()
+    defer l.mu.Unlock()
+    return len(l.Deployed) != 0 && l.Deployed[len(l.Deployed) - 1] == sha
+}
+
+// AddDeployed records a commit as the one last deployed.
+func (l *Ledger) AddDeployed(sha string) {
+    l.mu.Lock()
+    defer l.mu.Unlock()
+    if len(l.Deployed) != 0 && l.Deployed[len(l.Deployed) - 1] == sha {
+        return
+    }
+    l.Deployed = appendBounded(l.Deployed, sha, LedgerSize)
+    l.save()
+}
+
+func (l *Ledger) save() {
+    body, err := json.Marshal(l)
+    if err != nil {
+        slog.Error("Failed to encode ledger", "err", err)
+        return
+    }
+
+    tmp := l.path + ".tmp"
+    if err = ioutil.WriteFile(tmp, body, 0600); err != nil {
+        slog.Error("Failed to save ledger", "err", err)
+        return
+    }
+    if err = os.Rename(tmp, l.path); err != nil {
+        slog.Error("Failed to save ledger", "err", err)
+    }
+}
+
+func contains(list []string, v string) bool {
+    for _, x := range list {
+        if x == v {
+            return true
+        }
+    }
+    return false
+}
+
+// appendBounded appends v to list, dropping the oldest entries past max.
+func appendBounded(list []string, v string, max int) []string {
+    list = append(list, v)
+    if len(list) > max {
+        list = list[len(list) - max:]
+    }
+    return list
+}
+
+// Queue runs deployment jobs one at a time so that concurrent pushes don't
+// clobber each other's generated config on the firewall.
+type Queue struct {
+    jobs chan *Job
+    stop chan struct{}
+    done chan struct{}
+
+    mu sync.Mutex
+    current *Job
+    leftover []*Job
+}
+
+// NewQueue returns a queue that holds up to size pending jobs.
+func NewQueue(size int) *Queue {
+    return &Queue{
+        jobs: make(chan *Job, size),
+        stop: make(chan struct{}),
+        done: make(chan struct{}),
+    }
+}
+
+// Enqueue adds a job to the queue without blocking.
+func (q *Queue) Enqueue(job *Job) error {
+    select {
+    case q.jobs <- job:
+        return nil
+    default:
+        return fmt.Errorf("Job queue is full")
+    }
+}
+
+// Run is the queue's worker loop.  It returns once Stop is called and the
+// current job, if any, is finished.
+func (q *Queue) Run() {
+    defer close(q.done)
+
+    for {
+        select {
+        case <-q.stop:
+            return
+        case job := <-q.jobs:
+            q.mu.Lock()
+            select {
+            case <-q.stop:
+                q.leftover = append(q.leftover, job)
+                q.mu.Unlock()
+                return
+            default:
+                q.current = job
+            }
+            q.mu.Unlock()
+
+            runJob(job)
+
+            q.mu.Lock()
+            q.current = nil
+            q.mu.Unlock()
+        }
+    }
+}
+
+// Stop tells the worker not to start any more jobs.
+func (q *Queue) Stop() {
+    q.mu.Lock()
+    close(q.stop)
+    q.mu.Unlock()
+}
+
+// Done is closed once the worker has stopped.
+func (q *Queue) Done() <-chan struct{} {
+    return q.done
+}
+
+// Interrupt interrupts the job the worker is running, if any.
+func (q *Queue) Interrupt() {
+    q.mu.Lock()
+    defer q.mu.Unlock()
+
+    if q.current != nil {
+        q.current.Interrupt()
+    }
+}
+
+// Cancel cancels the job the worker is running, if any.
+func (q *Queue) Cancel() {
+    q.mu.Lock()
+    defer q.mu.Unlock()
+
+    if q.current != nil {
+        q.current.Cancel()
+    }
+}
+
+// Pending returns the jobs that were queued but never started.  Only call
+// this after the worker has stopped.
+func (q *Queue) Pending() []*Job {
+    ans := q.leftover
+    for {
+        select {
+        case job := <-q.jobs:
+            ans = append(ans, job)
+        default:
+            return ans
+        }
+    }
+}
+
+// runJob runs a single job and reports its outcome.
+func runJob(job *Job) {
+    if job.Cancelled() {
+        job.Log().Info("Job was cancelled before it started")
+        job.Finish(nil)
+        return
+    }
+
+    job.Start(config.JobLogDir)
+    job.Log().Info("Starting job", "log_file", job.Status(false).LogFile)
+    if job.Kind == KindPlan {
+        err := plan(job)
+        job.Finish(err)
+        if err != nil {
+            job.Log().Error("Job failed", "err", err)
+            return
+        }
+        job.Log().Info("Job done")
+        return
+    }
+
+    setCommitStatus(job, "pending", "Deploying to the firewall")
+    err := deploy(job)
+    job.Finish(err)
+    metrics.Deployed(job.Status(false).State)
+    if s := job.Status(false); s.State == JobCancelled {
+        job.Log().Info("Job cancelled")
+        setCommitStatus(job, "error", fmt.Sprintf("%s cancelled", stageLabel(s.Method, s.Stage)))
+        return
+    } else if err != nil {
+        job.Log().Error("Job failed", "err", err)
+        setCommitStatus(job, "failure", fmt.Sprintf("%s failed", stageLabel(s.Method, s.Stage)))
+        return
+    }
+    job.Log().Info("Job done")
+    job.tenant.Ledger.AddDeployed(job.Sha)
+    metrics.DeploySucceeded(job.Config().Hostname, *job.Status(false).Ended)
+    setCommitStatus(job, "success", "Deployed to the firewall")
+}
+
+// Metrics are the deployment pipeline's Prometheus metrics, served from
+// /metrics in the text exposition format.
+type Metrics struct {
+    mu sync.Mutex
+    received map[string]float64
+    rejected map[string]float64
+    deployed map[string]float64
+    stages map[[2]string]*Histogram
+    lastDeploy map[string]time.Time
+}
+
+// Histogram is a Prometheus style histogram with cumulative buckets.
+type Histogram struct {
+    Counts []uint64
+    Sum float64
+    Count uint64
+}
+
+// NewMetrics returns an empty set of metrics.
+func NewMetrics() *Metrics {
+    return &Metrics{
+        received: make(map[string]float64),
+        rejected: make(map[string]float64),
+        deployed: make(map[string]float64),
+        stages: make(map[[2]string]*Histogram),
+        lastDeploy: make(map[string]time.Time),
+    }
+}
+
+// Received counts a webhook from the given provider.
+func (m *Metrics) Received(provider string) {
+    m.mu.Lock()
+    m.received[provider]++
+    m.mu.Unlock()
+}
+
+// Rejected counts a webhook that didn't lead to a job being run.
+func (m *Metrics) Rejected(reason string) {
+    m.mu.Lock()
+    m.rejected[reason]++
+    m.mu.Unlock()
+}
+
+// Deployed counts a finished deployment by its final state.
+func (m *Metrics) Deployed(state string) {
+    m.mu.Lock()
+    m.deployed[state]++
+    m.mu.Unlock()
+}
+
+// DeploySucceeded records when the firewall was last deployed to.
+func (m *Metrics) DeploySucceeded(firewall string, when time.Time) {
+    m.mu.Lock()
+    m.lastDeploy[firewall] = when
+    m.mu.Unlock()
+}
+
+// ObserveStage records how long a pipeline stage took.
+func (m *Metrics) ObserveStage(stage, method string, d time.Duration) {
+    m.mu.Lock()
+    defer m.mu.Unlock()
+
+    key := [2]string{stage, method}
+    h := m.stages[key]
+    if h == nil {
+        h = &Histogram{Counts: make([]uint64, len(StageBuckets))}
+        m.stages[key] = h
+    }
+    secs := d.Seconds()
+    for i, le := range StageBuckets {
+        if secs <= le {
+            h.Counts[i]++
+        }
+    }
+    h.Sum += secs
+    h.Count++
+}
+
+// Write writes the metrics in the Prometheus text exposition format.
+func (m *Metrics) Write(w io.Writer, queueDepths map[string]int) {
+    m.mu.Lock()
+    defer m.mu.Unlock()
+
+    writeCounters(w, "las_webhooks_received_total", "Webhooks received, by provider.", "provider", m.received)
+    writeCounters(w, "las_webhooks_rejected_total", "Webhooks that didn't lead to a job, by reason.", "reason", m.rejected)
+    writeCounters(w, "las_deployments_total", "Finished deployments, by result.", "result", m.deployed)
+
+    fmt.Fprintf(w, "# HELP las_stage_duration_seconds Time taken by each pipeline stage.\n")
+    fmt.Fprintf(w, "# TYPE las_stage_duration_seconds histogram\n")
+    keys := make([][2]string, 0, len(m.stages))
+    for k := range m.stages {
+        keys = append(keys, k)
+    }
+    sort.Slice(keys, func(i, j int) bool {
+        return keys[i][0] < keys[j][0] || (keys[i][0] == keys[j][0] && keys[i][1] < keys[j][1])
+    })
+    for _, k := range keys {
+        h := m.stages[k]
+        labels := fmt.Sprintf("stage=\"%s\",exec=\"%s\"", labelValue(k[0]), labelValue(k[1]))
+        for i, le := range StageBuckets {
+            fmt.Fprintf(w, "las_stage_duration_seconds_bucket{%s,le=\"%g\"} %d\n", labels, le, h.Counts[i])
+        }
+        fmt.Fprintf(w, "las_stage_duration_seconds_bucket{%s,le=\"+Inf\"} %d\n", labels, h.Count)
+        fmt.Fprintf(w, "las_stage_duration_seconds_sum{%s} %g\n", labels, h.Sum)
+        fmt.Fprintf(w, "las_stage_duration_seconds_count{%s} %d\n", labels, h.Count)
+    }
+
+    depths := make(map[string]float64, len(queueDepths))
+    for tenant, n := range queueDepths {
+        depths[tenant] = float64(n)
+    }
+    fmt.Fprintf(w, "# HELP las_queue_depth Jobs waiting in each tenant's queue.\n")
+    fmt.Fprintf(w, "# TYPE las_queue_depth gauge\n")
+    writeSamples(w, "las_queue_depth", "tenant", depths)
+
+    last := make(map[string]float64, len(m.lastDeploy))
+    for fw, t := range m.lastDeploy {
+        last[fw] = float64(t.UnixNano()) / 1e9
+    }
+    fmt.Fprintf(w, "# HELP las_last_successful_deploy_timestamp_seconds When each firewall was last deployed to.\n")
+    fmt.Fprintf(w, "# TYPE las_last_successful_deploy_timestamp_seconds gauge\n")
+    writeSamples(w, "las_last_successful_deploy_timestamp_seconds", "firewall", last)
+}
+
+// writeCounters writes a counter with a single label.
+func writeCounters(w io.Writer, name, help, label string, values map[string]float64) {
+    fmt.Fprintf(w, "# HELP %s %s\n", name, help)
+    fmt.Fprintf(w, "# TYPE %s counter\n", name)
+    writeSamples(w, name, label, values)
+}
+
+// writeSamples writes one sample per label value, sorted by label value.
+func writeSamples(w io.Writer, name, label string, values map[string]float64) {
+    keys := make([]string, 0, len(values))
+    for k := range values {
+        keys = append(keys, k)
+    }
+    sort.Strings(keys)
+    for _, k := range keys {
+        fmt.Fprintf(w, "%s{%s=\"%s\"} %g\n", name, label, labelValue(k), values[k])
+    }
+}
+
+// labelValue escapes a label value for the text exposition format.
+func labelValue(v string) string {
+    return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(v)
+}
+
+// Depth returns the number of jobs waiting in the queue.
+func (q *Queue) Depth() int {
+    return len(q.jobs)
+}
+
+// FirewallStatus is whether the firewall is usable, as reported by /readyz.
+type FirewallStatus struct {
+    Ready bool `json:"ready"`
+    Hostname string `json:"hostname"`
+    Model string `json:"model,omitempty"`
+    Version string `json:"version,omitempty"`
+    Serial string `json:"serial,omitempty"`
+    LastContact *time.Time `json:"last_contact,omitempty"`
+    Error string `json:"error,omitempty"`
+}
+
+// FirewallMonitor waits for the firewall to come up, then keeps checking that
+// it's reachable and still accepts our credentials.
+type FirewallMonitor struct {
+    mu sync.Mutex
+    fw *pango.Firewall
+    status FirewallStatus
+    apps map[string]bool
+    appsFetched time.Time
+
+    // call serializes the use of fw, which jobs share with the monitor.
+    call sync.Mutex
+}
+
+// NewFirewallMonitor returns a monitor for the given firewall client.
+func NewFirewallMonitor(fw *pango.Firewall) *FirewallMonitor {
+    return &FirewallMonitor{
+        fw: fw,
+        status: FirewallStatus{Hostname: fw.Hostname, Error: "Not checked yet"},
+    }
+}
+
+// Status returns the firewall's last known status.
+func (m *FirewallMonitor) Status() FirewallStatus {
+    m.mu.Lock()
+    defer m.mu.Unlock()
+    return m.status
+}
+
+// Run checks the firewall forever: often until it's ready, then less often
+// to notice if it goes away.
+func (m *FirewallMonitor) Run() {
+    for {
+        ready := m.check()
+        if ready {
+            time.Sleep(FirewallCheckInterval)
+        } else {
+            time.Sleep(FirewallRetryInterval)
+        }
+    }
+}
+
+// check contacts the firewall once and updates its status.  Until the
+// firewall is ready, this logs in from scratch, which verifies the
+// credentials and fetches the system info.  After that, it only asks for the
+// system info.
+func (m *FirewallMonitor) check() bool {
+    var err error
+
+    was := m.Status()
+    m.call.Lock()
+    if !was.Ready {
+        m.fw.ApiKey = ""
+        err = m.fw.Initialize()
+    } else {
+        _, err = m.fw.Op("<show><system><info/></system></show>", "", nil, nil)
+    }
+    m.call.Unlock()
+
+    m.mu.Lock()
+    defer m.mu.Unlock()
+
+    if err != nil {
+        if was.Ready || was.Error != err.Error() {
+            slog.Warn("Firewall is not ready", "firewall", m.fw.Hostname, "err", err)
+        }
+        m.status.Ready = false
+        m.status.Error = err.Error()
+        return false
+    }
+
+    now := time.Now()
+    m.status.Ready = true
+    m.status.Error = ""
+    m.status.LastContact = &now
+    if !was.Ready {
+        m.status.Model = m.fw.SystemInfo["model"]
+        m.status.Version = m.fw.SystemInfo["sw-version"]
+        m.status.Serial = m.fw.SystemInfo["serial"]
+        slog.Info("Firewall is ready", "firewall", m.fw.Hostname, "model", m.status.Model, "version", m.status.Version, "serial", m.status.Serial)
+    }
+    return true
+}
+
+// predefinedApps is the names of the firewall's predefined applications.
+type predefinedApps struct {
+    Entries []struct {
+        Name string `xml:"name,attr"`
+    } `xml:"result>entry"`
+}
+
+// Applications returns the names of the firewall's predefined App-ID
+// applications.  They're only fetched once the firewall is ready, and are
+// fetched again once they're older than ApplicationsMaxAge, as content
+// updates add applications.
+func (m *FirewallMonitor) Applications() (map[string]bool, error) {
+    m.mu.Lock()
+    ready, apps, fetched := m.status.Ready, m.apps, m.appsFetched
+    m.mu.Unlock()
+
+    if !ready {
+        return nil, fmt.Errorf("Firewall is not ready")
+    } else if apps != nil && time.Since(fetched) < ApplicationsMaxAge {
+        return apps, nil
+    }
+
+    // Only the names are fetched; the applications' definitions run to
+    // megabytes.
+    list := predefinedApps{}
+    m.call.Lock()
+    _, err := m.fw.Get("/config/predefined/application/entry/@name", nil, &list)
+    m.call.Unlock()
+    if err != nil {
+        return nil, fmt.Errorf("Failed to get the predefined applications: %s", err)
+    } else if len(list.Entries) == 0 {
+        return nil, fmt.Errorf("Firewall has no predefined applications; is its content installed?")
+    }
+
+    apps = make(map[string]bool, len(list.Entries))
+    for _, e := range list.Entries {
+        apps[e.Name] = true
+    }
+
+    m.mu.Lock()
+    m.apps, m.appsFetched = apps, time.Now()
+    m.mu.Unlock()
+    return apps, nil
+}
+
+// Tenant is a repo that's deployed to a firewall of its own.  Each tenant has
+// its own working directory, ledger, job queue and firewall connection, so
+// tenants don't see or hold up each other's deployments.
+type Tenant struct {
+    Name string
+    Config HookConfig
+    Queue *Queue
+    Ledger *Ledger
+    Firewall *FirewallMonitor
+}
+
+// NewTenant sets up a tenant with its effective config.
+func NewTenant(name string, c HookConfig) *Tenant {
+    t := &Tenant{
+        Name: name,
+        Config: c,
+        Queue: NewQueue(QueueSize),
+        Firewall: NewFirewallMonitor(newFirewall(&c)),
+    }
+
+    var err error
+    if t.Ledger, err = LoadLedger(c.LedgerFile); err != nil {
+        slog.Warn("Starting with an empty ledger", "tenant", name, "err", err)
+    }
+    return t
+}
+
+// tenantList returns all tenants, sorted by name.
+func tenantList() []*Tenant {
+    ans := make([]*Tenant, 0, len(tenants))
+    for _, t := range tenants {
+        ans = append(ans, t)
+    }
+    sort.Slice(ans, func(i, j int) bool {
+        return ans[i].Name < ans[j].Name
+    })
+    return ans
+}
+
+// TenantConfig is a tenant's entry in "tenants" in config.json.  Settings it
+// leaves out are inherited from the top level config.
+type TenantConfig struct {
+    Repo string `json:"repo"`
+    GitHubAccount string `json:"github_account"`
+    Provider string `json:"provider"`
+    WebhookSecret string `json:"webhook_secret" secret:"true"`
+    GitHubToken string `json:"github_token" secret:"true"`
+    GitHubApiUrl string `json:"github_api_url"`
+    Hostname string `json:"hostname"`
+    Username string `json:"username"`
+    Password string `json:"password" secret:"true"`
+    BaseDir string `json:"base_dir"`
+    Exec string `json:"exec"`
+    Refs []string `json:"refs"`
+    PlanUsers []string `json:"plan_users"`
+    ApiToken string `json:"api_token" secret:"true"`
+}
+
+// HookConfig is las's configuration.  Settings tagged as secret can be
+// references to where the secret is kept (see resolveSecret), and are
+// redacted by "las config show".
+type HookConfig struct {
+    Hostname string `json:"hostname"`
+    Username string `json:"username"`
+    Password string `json:"password" secret:"true"`
+    GitHubAccount string `json:"github_account"`
+    Provider string `json:"provider"`
+    Repo string `json:"repo"`
+    WebhookSecret string `json:"webhook_secret" secret:"true"`
+    Refs []string `json:"refs"`
+    PlanUsers []string `json:"plan_users"`
+    GitHubToken string `json:"github_token" secret:"true"`
+    GitHubApiUrl string `json:"github_api_url"`
+    PublicUrl string `json:"public_url"`
+    ApiToken string `json:"api_token" secret:"true"`
+    ShutdownTimeout int `json:"shutdown_timeout"`
+    StageTimeouts map[string]int `json:"stage_timeouts"`
+    Listen string `json:"listen"`
+    TlsCert string `json:"tls_cert"`
+    TlsKey string `json:"tls_key"`
+    TlsSelfSigned bool `json:"tls_self_signed"`
+    TlsClientCa string `json:"tls_client_ca"`
+    RedirectListen string `json:"redirect_listen"`
+    LogFile string `json:"log_file"`
+    LogFormat string `json:"log_format"`
+    LogMaxSize int `json:"log_max_size_mb"`
+    LogMaxAge int `json:"log_max_age_hours"`
+    LogKeep int `json:"log_keep"`
+    JobLogDir string `json:"job_log_dir"`
+    BaseDir string `json:"base_dir"`
+    DemoDir string `json:"demo_dir"`
+    AnsiblePlaybook string `json:"ansible_playbook"`
+    Terraform string `json:"terraform"`
+    Commit string `json:"commit"`
+    LedgerFile string `json:"ledger_file"`
+    QueueFile string `json:"queue_file"`
+    SecretKeyFile string `json:"secret_key_file"`
+    Exec string `json:"exec"`
+    Tenants map[string]TenantConfig `json:"tenants"`
+}
+
+// shaRe matches a full git commit SHA.
+var shaRe = regexp.MustCompile(`^[0-9a-f]{40}$`)
+
+// baseRe matches the base revision of a pull request: a commit SHA or a
+// remote branch.
+var baseRe = regexp.MustCompile(`^([0-9a-f]{40}|origin/[A-Za-z0-9._/-]+)$`)
+
+// StageBuckets are the upper bounds, in seconds, of the stage duration
+// histogram's buckets.
+var StageBuckets = []float64{1, 5, 15, 30, 60, 120, 300, 600, 1200}
+
+// zoneRe matches PAN-OS zone names.
+var zoneRe = regexp.MustCompile(`^[0-9A-Za-z][0-9A-Za-z ._-]{0,30}$`)
+
+// appNameRe matches the names of apps, which leaves room for the "Allow "
+// and "-tcp" their rules and service objects add within the 63 characters of
+// an object name.
+var appNameRe = regexp.MustCompile(`^[0-9A-Za-z][0-9A-Za-z ._-]{0,56}$`)
+
+// objectNameRe matches PAN-OS object names, such as address objects.
+var objectNameRe = regexp.MustCompile(`^[0-9A-Za-z][0-9A-Za-z ._-]{0,62}$`)
+
+// ipLikeRe matches what looks like an IPv4 address or CIDR rather than an
+// object name, so it's checked as one.
+var ipLikeRe = regexp.MustCompile(`^[0-9.]+(/[0-9]*)?$`)
+
+// fqdnRe matches fully qualified domain names.
+var fqdnRe = regexp.MustCompile(`^[0-9A-Za-z]([0-9A-Za-z-]{0,61}[0-9A-Za-z])?(\.[0-9A-Za-z]([0-9A-Za-z-]{0,61}[0-9A-Za-z])?)+\.?$`)
+
+// dynamicFilterRe matches the tag filters of dynamic address groups, which
+// are written into the generated configs in double quotes.
+var dynamicFilterRe = regexp.MustCompile(`^[0-9A-Za-z '()._:/-]+$`)
+
+// tenantRe matches the names of tenants, which are used in webhook URLs.
+var tenantRe = regexp.MustCompile(`^[A-Za-z0-9._-]+$`)
+
+// CredentialStages are the stages whose subprocesses talk to the firewall:
+// terraform plan and apply, ansible-playbook and the commit binary.
+var CredentialStages = map[string]bool{
+    StagePlan: true,
+    StageApply: true,
+    StageCommit: true,
+}
+
+// DefaultStageTimeouts are how long subprocesses in each stage may run unless
+// overridden by "stage_timeouts" in config.json.
+var DefaultStageTimeouts = map[string]time.Duration{
+    StagePull: 2 * time.Minute,
+    StageInit: 5 * time.Minute,
+    StagePlan: 10 * time.Minute,
+    StageApply: 20 * time.Minute,
+    StageCommit: 20 * time.Minute,
+}
+
+// defaultApiUrls are the public API endpoints of each provider.
+var defaultApiUrls = map[string]string{
+    "github": "https://api.github.com",
+    "gitlab": "https://gitlab.com/api/v4",
+}
+
+// Global variables.
+var config HookConfig
+var tenants map[string]*Tenant
+var lf *RotatingLog
+var jobs *JobStore
+var metrics = NewMetrics()
+var apiClient = &http.Client{Timeout: 10 * time.Second}
+var ansibleBegin []byte
+var terraformBegin []byte
+
+// Provider adapts one git hosting service's webhooks and API to las.
+type Provider interface {
+    // Verify authenticates a webhook request using the shared secret.
+    Verify(r *http.Request, body []byte, secret string) error
+
+    // Parse turns an authenticated webhook request into an Event.  A nil
+    // Event means the request is valid but needs no action.
+    Parse(r *http.Request, body []byte) (*Event, error)
+
+    // SetStatus reports a job's state on its commit.
+    SetStatus(job *Job, state, description, targetUrl string) error
+
+    // Comment posts a comment on a plan job's pull or merge request.
+    Comment(job *Job, body string) error
+}
+
+// providers maps the "provider" config setting to its implementation.
+var providers = map[string]Provider{
+    "github": GitHub{},
+    "gitea": Gitea{},
+    "gitlab": GitLab{},
+}
+
+// GitHub signs webhooks with X-Hub-Signature-256.
+type GitHub struct{}
+
+func (GitHub) Verify(r *http.Request, body []byte, secret string) error {
+    sig := r.Header.Get("X-Hub-Signature-256")
+    if sig == "" {
+        return fmt.Errorf("No X-Hub-Signature-256 header present")
+    } else if !strings.HasPrefix(sig, "sha256=") {
+        return fmt.Errorf("Unsupported signature format: %q", sig)
+    }
+
+    return verifyHmac(strings.TrimPrefix(sig, "sha256="), body, secret)
+}
+
+func (GitHub) Parse(r *http.Request, body []byte) (*Event, error) {
+    return parseGitHubEvent(r.Header.Get("X-GitHub-Event"), r.Header.Get("X-GitHub-Delivery"), body, "synchronize")
+}
+
+func (GitHub) SetStatus(job *Job, state, description, targetUrl string) error {
+    status := map[string]string{
+        "state": state,
+        "description": description,
+        "context": StatusContext,
+    }
+    if targetUrl != "" {
+        status["target_url"] = targetUrl
+    }
+
+    return githubApi(job.Config(), job.Provider, fmt.Sprintf("/repos/%s/statuses/%s", job.Repo, job.Sha), status)
+}
+
+func (GitHub) Comment(job *Job, body string) error {
+    return githubApi(job.Config(), job.Provider, fmt.Sprintf("/repos/%s/issues/%d/comments", job.Repo, job.PullRequest), map[string]string{"body": body})
+}
+
+// Gitea's webhooks and API mirror GitHub's, but it signs webhooks with a bare
+// hex HMAC in X-Gitea-Signature.
+type Gitea struct {
+    GitHub
+}
+
+func (Gitea) Verify(r *http.Request, body []byte, secret string) error {
+    sig := r.Header.Get("X-Gitea-Signature")
+    if sig == "" {
+        return fmt.Errorf("No X-Gitea-Signature header present")
+    }
+
+    return verifyHmac(sig, body, secret)
+}
+
+func (Gitea) Parse(r *http.Request, body []byte) (*Event, error) {
+    return parseGitHubEvent(r.Header.Get("X-Gitea-Event"), r.Header.Get("X-Gitea-Delivery"), body, "synchronized")
+}
+
+// GitLab sends the shared secret as-is in X-Gitlab-Token.
+type GitLab struct{}
+
+func (GitLab) Verify(r *http.Request, body []byte, secret string) error {
+    token := r.Header.Get("X-Gitlab-Token")
+    if token == "" {
+        return fmt.Errorf("No X-Gitlab-Token header present")
+    } else if subtle.ConstantTimeCompare([]byte(token), []byte(secret)) != 1 {
+        return fmt.Errorf("Token mismatch")
+    }
+
+    return nil
+}
+
+func (GitLab) Parse(r *http.Request, body []byte) (*Event, error) {
+    event := r.Header.Get("X-Gitlab-Event")
+    delivery := r.Header.Get("X-Gitlab-Event-UUID")
+
+    switch event {
+    case "":
+        return nil, fmt.Errorf("No X-Gitlab-Event header present")
+    case "Push Hook", "Tag Push Hook":
+        e := GitLabPush{}
+        if err := json.Unmarshal(body, &e); err != nil {
+            return nil, fmt.Errorf("Invalid push payload: %s", err)
+        }
+
+        // An annotated tag's "after" is the tag object; checkout_sha is the
+        // commit it points to.
+        sha := e.After
+        if e.CheckoutSha != "" && e.After != ZeroSha {
+            sha = e.CheckoutSha
+        }
+        ev := &Event{
+            Kind: EventPush,
+            Delivery: delivery,
+            Repo: e.Project.Name,
+            Ref: e.Ref,
+            Sha: sha,
+            Deleted: e.After == ZeroSha,
+            DefaultBranch: e.Project.DefaultBranch,
+            Pusher: e.UserUsername,
+            Message: DefaultMessage,
+        }
+
+        // Tag pushes and pushes of a branch back to an existing commit come
+        // without the commit in "commits".
+        for _, c := range e.Commits {
+            if c.Id == sha {
+                ev.Message = c.Message
+            }
+        }
+        return ev, nil
+    case "Merge Request Hook":
+        e := GitLabMergeRequest{}
+        if err := json.Unmarshal(body, &e); err != nil {
+            return nil, fmt.Errorf("Invalid merge request payload: %s", err)
+        }
+
+        a := e.Attrs
+        slog.Info("Merge request event", "merge_request", a.Iid, "action", a.Action, "source", a.SourceBranch, "target", a.TargetBranch, "sha", a.LastCommit.Id)
+
+        // Only new merge requests or ones with new commits need a plan.
+        if a.Action != "open" && a.Action != "reopen" && (a.Action != "update" || a.Oldrev == "") {
+            return nil, nil
+        }
+
+        return &Event{
+            Kind: EventPullRequest,
+            Delivery: delivery,
+            Repo: e.Project.Name,
+            Ref: a.SourceBranch,
+            Sha: a.LastCommit.Id,
+            Pusher: e.User.Username,
+            PullRequest: a.Iid,
+            FetchRef: fmt.Sprintf("refs/merge-requests/%d/head", a.Iid),
+            Base: "origin/" + a.TargetBranch,
+        }, nil
+    }
+
+    slog.Info("Ignoring unsupported event", "event", event)
+    return nil, nil
+}
+
+func (GitLab) SetStatus(job *Job, state, description, targetUrl string) error {
+    if state == "failure" {
+        state = "failed"
+    } else if state == "error" {
+        state = "canceled"
+    }
+    status := map[string]string{
+        "state": state,
+        "description": description,
+        "name": StatusContext,
+    }
+    if targetUrl != "" {
+        status["target_url"] = targetUrl
+    }
+
+    return gitlabApi(job.Config(), fmt.Sprintf("/projects/%s/statuses/%s", url.PathEscape(job.Repo), job.Sha), status)
+}
+
+func (GitLab) Comment(job *Job, body string) error {
+    return gitlabApi(job.Config(), fmt.Sprintf("/projects/%s/merge_requests/%d/notes", url.PathEscape(job.Repo), job.PullRequest), map[string]string{"body": body})
+}
+
+// verifyHmac checks a hex encoded HMAC-SHA256 of the body keyed with the
+// webhook secret.
+func verifyHmac(sig string, body []byte, secret string) error {
+    given, err := hex.DecodeString(sig)
+    if err != nil {
+        return fmt.Errorf("Failed to decode signature: %s", err)
+    }
+
+    mac := hmac.New(sha256.New, []byte(secret))
+    mac.Write(body)
+    if !hmac.Equal(given, mac.Sum(nil)) {
+        return fmt.Errorf("Signature mismatch")
+    }
+
+    return nil
+}
+
+// parseGitHubEvent parses the GitHub style webhooks that both GitHub and
+// Gitea send.  The providers differ in the pull request action sent when new
+// commits are pushed.
+func parseGitHubEvent(event, delivery string, body []byte, syncAction string) (*Event, error) {
+    switch event {
+    case "":
+        return nil, fmt.Errorf("No event header present")
+    case "ping":
+        p := Ping{}
+        if err := json.Unmarshal(body, &p); err != nil {
+            return nil, fmt.Errorf("Invalid ping payload: %s", err)
+        }
+
+        slog.Info("Got ping event", "hook_id", p.Hook.Id, "hook_name", p.Hook.Name, "url", p.Hook.PingUrl, "zen", p.Zen)
+        return &Event{Kind: EventPing, Delivery: delivery}, nil
+    case "push":
+        data := Payload{}
+        if err := json.Unmarshal(body, &data); err != nil {
+            slog.Debug("Invalid push payload", "delivery", delivery, "body", string(body))
+            return nil, fmt.Errorf("Invalid push payload: %s", err)
+        }
+
+        pusher := data.From.Name
+        if pusher == "" {
+            pusher = data.From.Login
+        }
+        return &Event{
+            Kind: EventPush,
+            Delivery: delivery,
+            Repo: data.Repo.Name,
+            Ref: data.Ref,
+            Sha: data.After,
+            Deleted: data.Deleted,
+            DefaultBranch: data.Repo.DefaultBranch,
+            Pusher: pusher,
+            Message: data.Commit.Msg,
+        }, nil
+    case "pull_request":
+        e := PullRequestEvent{}
+        if err := json.Unmarshal(body, &e); err != nil {
+            return nil, fmt.Errorf("Invalid pull_request payload: %s", err)
+        }
+
+        slog.Info("Pull request event", "pull_request", e.Number, "action", e.Action, "head", e.PullRequest.Head.Ref, "base", e.PullRequest.Base.Ref, "sha", e.PullRequest.Head.Sha)
+
+        // Only new or updated pull requests need a fresh plan.
+        if e.Action != "opened" && e.Action != "reopened" && e.Action != syncAction {
+            return nil, nil
+        }
+
+        return &Event{
+            Kind: EventPullRequest,
+            Delivery: delivery,
+            Repo: e.Repo.Name,
+            Ref: e.PullRequest.Head.Ref,
+            Sha: e.PullRequest.Head.Sha,
+            Pusher: e.Sender.Login,
+            PullRequest: e.Number,
+            FetchRef: fmt.Sprintf("refs/pull/%d/head", e.Number),
+            Base: e.PullRequest.Base.Sha,
+        }, nil
+    case "create":
+        e := CreateEvent{}
+        if err := json.Unmarshal(body, &e); err != nil {
+            return nil, fmt.Errorf("Invalid create payload: %s", err)
+        }
+
+        slog.Info("Create event", "ref_type", e.RefType, "ref", e.Ref, "repo", e.Repo.Name)
+        return nil, nil
+    case "issue_comment":
+        e := IssueCommentEvent{}
+        if err := json.Unmarshal(body, &e); err != nil {
+            return nil, fmt.Errorf("Invalid issue_comment payload: %s", err)
+        }
+
+        slog.Info("Comment event", "action", e.Action, "issue", e.Issue.Number, "user", e.Comment.User.Login)
+        return nil, nil
+    }
+
+    slog.Info("Ignoring unsupported event", "event", event)
+    return nil, nil
+}
+
+func handleReq(w http.ResponseWriter, r *http.Request) {
+    var err error
+
+    // GitHub doesn't send payloads over 25 MB, so anything bigger is refused
+    // before it's read into memory, let alone checked.
+    body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, MaxPayloadSize))
+    if tooLarge := (*http.MaxBytesError)(nil); errors.As(err, &tooLarge) {
+        slog.Warn("Rejecting oversized webhook", "remote", r.RemoteAddr, "limit", tooLarge.Limit)
+        metrics.Received("unknown")
+        metrics.Rejected("too_large")
+        http.Error(w, "Payload too large", http.StatusRequestEntityTooLarge)
+        return
+    } else if err != nil {
+        slog.Error("Failed to read request body", "remote", r.RemoteAddr, "err", err)
+        return
+    }
+
+    // Webhooks sent to /hooks/<tenant> can only be for that tenant.
+    candidates := tenantList()
+    if name := strings.TrimPrefix(r.URL.Path, "/hooks/"); name != r.URL.Path {
+        t := tenants[name]
+        if t == nil {
+            slog.Warn("Rejecting webhook for unknown tenant", "remote", r.RemoteAddr, "tenant", name)
+            metrics.Received("unknown")
+            metrics.Rejected("tenant")
+            http.NotFound(w, r)
+            return
+        }
+        candidates = []*Tenant{t}
+    }
+
+    // Refuse anything not signed with a tenant's webhook secret.
+    t, ev, err := findTenant(r, body, candidates)
+    if t == nil {
+        slog.Warn("Rejecting webhook", "remote", r.RemoteAddr, "err", err)
+        metrics.Received("unknown")
+        metrics.Rejected("signature")
+        http.Error(w, "Invalid signature", http.StatusUnauthorized)
+        return
+    }
+    metrics.Received(t.Config.Provider)
+
+    if err != nil {
+        slog.Warn("Invalid webhook", "remote", r.RemoteAddr, "tenant", t.Name, "err", err)
+        metrics.Rejected("payload")
+        http.Error(w, err.Error(), http.StatusBadRequest)
+        return
+    } else if ev == nil {
+        metrics.Rejected("unsupported_event")
+        w.WriteHeader(http.StatusNoContent)
+        return
+    }
+    slog.Info("Webhook received", "tenant", t.Name, "event", ev.Kind, "delivery", ev.Delivery, "ref", ev.Ref, "sha", ev.Sha)
+
+    switch ev.Kind {
+    case EventPing:
+        fmt.Fprintf(w, "pong")
+    case EventPush:
+        handlePush(w, t, ev)
+    case EventPullRequest:
+        handlePullRequest(w, t, ev)
+    }
+}
+
+// findTenant works out which of the candidate tenants a webhook is for, and
+// parses it with that tenant's provider.  The webhook must be signed with the
+// tenant's secret; if several tenants share a secret, the one whose repo the
+// event is about wins.  A nil tenant means no candidate accepts the
+// signature, and a nil event with no error means the event isn't supported.
+func findTenant(r *http.Request, body []byte, candidates []*Tenant) (*Tenant, *Event, error) {
+    var err error
+    var match *Tenant
+    var matchEv *Event
+
+    for _, t := range candidates {
+        provider := providers[t.Config.Provider]
+        if err = provider.Verify(r, body, t.Config.WebhookSecret); err != nil {
+            continue
+        }
+
+        ev, perr := provider.Parse(r, body)
+        if perr != nil || ev == nil {
+            return t, nil, perr
+        }
+        ev.Provider = t.Config.Provider
+        if ev.Repo == "" || ev.Repo == t.Config.RepoName() {
+            return t, ev, nil
+        } else if match == nil {
+            match, matchEv = t, ev
+        }
+    }
+
+    if match != nil {
+        return match, matchEv, nil
+    }
+    return nil, nil, err
+}
+
+func handlePullRequest(w http.ResponseWriter, t *Tenant, ev *Event) {
+    if ev.Repo != t.Config.RepoName() {
+        slog.Warn("Invalid repo name", "delivery", ev.Delivery, "repo", ev.Repo)
+        metrics.Rejected("invalid")
+        w.WriteHeader(http.StatusNoContent)
+        return
+    } else if !shaRe.MatchString(ev.Sha) || !baseRe.MatchString(ev.Base) {
+        slog.Warn("Invalid pull request revisions", "delivery", ev.Delivery, "sha", ev.Sha, "base", ev.Base)
+        metrics.Rejected("payload")
+        http.Error(w, "Invalid pull request payload", http.StatusBadRequest)
+        return
+    }
+
+    job := NewJob(t, KindPlan, ev)
+    if !t.Config.CanPlan(ev.Pusher) {
+        metrics.Rejected("sender")
+        skipJob(w, job, fmt.Sprintf("Pull requests from %q are not planned", ev.Pusher))
+        return
+    }
+    if t.Ledger.HasDelivery(ev.Delivery) {
+        metrics.Rejected("duplicate_delivery")
+        skipJob(w, job, fmt.Sprintf("Delivery %s was already handled", ev.Delivery))
+        return
+    }
+    if err := t.Queue.Enqueue(job); err != nil {
+        job.Log().Error("Failed to enqueue job", "err", err)
+        metrics.Rejected("queue_full")
+        http.Error(w, err.Error(), http.StatusServiceUnavailable)
+        return
+    }
+    jobs.Add(job)
+    t.Ledger.AddDelivery(ev.Delivery)
+    job.Log().Info("Queued plan job", "pull_request", ev.PullRequest)
+
+    writeJson(w, http.StatusAccepted, map[string]string{"id": job.Id})
+}
+
+func handlePush(w http.ResponseWriter, t *Tenant, ev *Event) {
+    var err error
+
+    if reason := ev.SkipReason(&t.Config); reason != "" {
+        metrics.Rejected("ref")
+        skipJob(w, NewJob(t, KindDeploy, ev), reason)
+        return
+    }
+    if err = ev.IsValid(&t.Config); err != nil {
+        slog.Warn("Invalid push", "delivery", ev.Delivery, "err", err)
+        metrics.Rejected("invalid")
+        skipJob(w, NewJob(t, KindDeploy, ev), err.Error())
+        return
+    }
+
+    slog.Info("Commit message", "delivery", ev.Delivery, "message", ev.Message)
+
+    // Verify the commit msg doesn't have characters the shell would interpret.
+    for _, v := range []string{"\"", "'", "`", "$"} {
+        if strings.Contains(ev.Message, v) {
+            slog.Info("Commit message contains a shell character, using the default message", "delivery", ev.Delivery, "char", v)
+            ev.Message = DefaultMessage
+            break
+        }
+    }
+
+    // Redelivered webhooks and the commit already on the firewall are not
+    // redeployed.
+    job := NewJob(t, KindDeploy, ev)
+    if t.Ledger.HasDelivery(ev.Delivery) {
+        metrics.Rejected("duplicate_delivery")
+        skipJob(w, job, fmt.Sprintf("Delivery %s was already handled", ev.Delivery))
+        return
+    } else if t.Ledger.IsDeployed(ev.Sha) {
+        metrics.Rejected("already_deployed")
+        skipJob(w, job, fmt.Sprintf("%s is the last deployed commit", ev.Sha))
+        return
+    }
+
+    // Hand the deployment off to the worker so the sender isn't kept waiting.
+    if err = t.Queue.Enqueue(job); err != nil {
+        job.Log().Error("Failed to enqueue job", "err", err)
+        metrics.Rejected("queue_full")
+        http.Error(w, err.Error(), http.StatusServiceUnavailable)
+        return
+    }
+    jobs.Add(job)
+    t.Ledger.AddDelivery(ev.Delivery)
+    job.Log().Info("Queued job")
+
+    writeJson(w, http.StatusAccepted, map[string]string{"id": job.Id})
+}
+
+// skipJob records a job that was acknowledged but not run.
+func skipJob(w http.ResponseWriter, job *Job, reason string) {
+    job.Skip(reason)
+    jobs.Add(job)
+    job.Log().Info("Skipping job", "reason", reason)
+    writeJson(w, http.StatusOK, map[string]string{"id": job.Id, "skipped": reason})
+}
+
+// DeployRequest is the body of a POST to /api/deploy.
+type DeployRequest struct {
+    Tenant string `json:"tenant"`
+    Sha string `json:"sha"`
+    Message string `json:"message"`
+}
+
+// handleDeploy serves /api/deploy, which deploys a given commit on purpose,
+// even if it was already deployed.
+func handleDeploy(w http.ResponseWriter, r *http.Request) {
+    if r.Method != http.MethodPost {
+        http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+        return
+    }
+    allowed := apiTenants(r)
+    if len(allowed) == 0 {
+        slog.Warn("Rejecting deploy request", "remote", r.RemoteAddr)
+        http.Error(w, "Unauthorized", http.StatusUnauthorized)
+        return
+    }
+
+    req := DeployRequest{}
+    if err := json.NewDecoder(io.LimitReader(r.Body, 4096)).Decode(&req); err != nil {
+        http.Error(w, fmt.Sprintf("Invalid request: %s", err), http.StatusBadRequest)
+        return
+    } else if !shaRe.MatchString(req.Sha) {
+        http.Error(w, "\"sha\" must be a full commit SHA", http.StatusBadRequest)
+        return
+    }
+    if req.Message == "" || strings.ContainsAny(req.Message, "\"'`$") {
+        req.Message = fmt.Sprintf("Redeploying %s", req.Sha[:7])
+    }
+
+    // The tenant can be left out if the token is only for one.
+    if req.Tenant == "" && len(allowed) == 1 {
+        for name := range allowed {
+            req.Tenant = name
+        }
+    }
+    t := tenants[req.Tenant]
+    if req.Tenant == "" {
+        http.Error(w, "\"tenant\" is required when there are several tenants", http.StatusBadRequest)
+        return
+    } else if t == nil {
+        http.Error(w, fmt.Sprintf("No such tenant %q", req.Tenant), http.StatusBadRequest)
+        return
+    } else if !allowed[req.Tenant] {
+        slog.Warn("Rejecting deploy request", "remote", r.RemoteAddr, "tenant", req.Tenant)
+        http.Error(w, fmt.Sprintf("Not authorized for tenant %q", req.Tenant), http.StatusForbidden)
+        return
+    }
+
+    job := NewJob(t, KindDeploy, &Event{
+        Provider: t.Config.Provider,
+        Repo: t.Config.RepoName(),
+        Sha: req.Sha,
+        Pusher: "api",
+        Message: req.Message,
+    })
+    if err := t.Queue.Enqueue(job); err != nil {
+        job.Log().Error("Failed to enqueue job", "err", err)
+        http.Error(w, err.Error(), http.StatusServiceUnavailable)
+        return
+    }
+    jobs.Add(job)
+    job.Log().Info("Queued redeploy job")
+
+    writeJson(w, http.StatusAccepted, map[string]string{"id": job.Id})
+}
+
+// apiTenants returns the tenants whose jobs the request's bearer token gives
+// access to: every tenant for the top level API token, or the tenant whose
+// own API token it is.  Tenants without an API token of their own use the top
+// level one.  Without a matching token, there are none.
+func apiTenants(r *http.Request) map[string]bool {
+    token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+    matches := func(want string) bool {
+        return want != "" && subtle.ConstantTimeCompare([]byte(token), []byte(want)) == 1
+    }
+
+    ans := make(map[string]bool)
+    all := matches(config.ApiToken)
+    for name, t := range tenants {
+        if all || matches(t.Config.ApiToken) {
+            ans[name] = true
+        }
+    }
+    return ans
+}
+
+// deploy applies the job's commit to the firewall.
+func deploy(job *Job) error {
+    _, err := runDemo(job, false)
+    return err
+}
+
+// plan previews the changes a pull request would make to the firewall and
+// posts a summary as a comment on the pull request.
+func plan(job *Job) error {
+    demo, err := runDemo(job, true)
+
+    base, berr := baseDemoConfig(job)
+    if berr != nil {
+        job.Log().Warn("No base config to compare against", "err", berr)
+    }
+
+    comment := planComment(job, base, demo, job.StageOutput(), err)
+    if cerr := providers[job.Provider].Comment(job, comment); cerr != nil {
+        job.Log().Error("Failed to comment on pull request", "pull_request", job.PullRequest, "err", cerr)
+    }
+
+    return err
+}
+
+// runDemo checks out the job's commit, renders the demo config and runs it
+// against the firewall.  If planOnly is set, changes are only previewed:
+// nothing is applied or committed.
+func runDemo(job *Job, planOnly bool) (*DemoConfig, error) {
+    var err error
+
+    c := job.Config()
+
+    // Check out the commit into its own worktree.
+    job.Log().Info("Checking out commit", "repo", job.Repo)
+    worktree, err := checkout(job)
+    if err != nil {
+        return nil, err
+    }
+    defer removeWorktree(job, worktree)
+
+    /*
+    // Copy all files into place.
+    if err = copyAllFiles(c); err != nil {
+        return nil, err
+    }
+    */
+
+    // Read the config from the repo.
+    job.SetStage(StageRender)
+    demo, err := loadDemoConfig(worktree, c.Exec)
+    if err != nil {
+        return nil, err
+    }
+    job.SetMethod(demo.Method)
+
+    // Applications are checked against the firewall when it's reachable;
+    // otherwise the firewall rejects unknown ones itself.
+    if known, err := job.tenant.Firewall.Applications(); err != nil {
+        job.Log().Warn("Not checking applications against the firewall", "err", err)
+    } else if err = demo.CheckApplications(known); err != nil {
+        return demo, err
+    }
+
+    // Perform the requested demo.
+    if demo.Method == "ansible" {
+        dstDir := fmt.Sprintf("%s/anchor", c.BaseDir)
+
+        job.Log().Info("Creating ansible playbooks")
+        job.SetDir(dstDir)
+
+        end, err := ansibleConfig(*demo)
+        if err != nil {
+            return demo, fmt.Errorf("Failed to create ansible config: %s", err)
+        }
+
+        fd, err := os.OpenFile(filepath.Join(dstDir, "deploy.yml"), os.O_WRONLY|os.O_TRUNC|os.O_CREATE, 0666)
+        if err != nil {
+            return demo, fmt.Errorf("Failed to open deploy.yml: %s", err)
+        }
+        defer fd.Close()
+
+        fmt.Fprintf(fd, "%s\n%s", ansibleBegin, end)
+
+        if planOnly {
+            job.Log().Info("Running Ansible in check mode")
+            if err = job.Run(StagePlan, c.AnsiblePlaybook, "--check", "--diff", "-i", "hosts", "deploy.yml"); err != nil {
+                return demo, fmt.Errorf("Failed to run ansible playbook in check mode: %s", err)
+            }
+            return demo, nil
+        }
+
+        job.Log().Info("Running Ansible to configure the firewall")
+        if err = job.Run(StageApply, c.AnsiblePlaybook, "-i", "hosts", "deploy.yml"); err != nil {
+            return demo, fmt.Errorf("Failed to run ansible playbook: %s", err)
+        }
+    } else if demo.Method == "terraform" {
+        dstDir := fmt.Sprintf("%s/tricky", c.BaseDir)
+
+        job.Log().Info("Updating terraform plan")
+        job.SetDir(dstDir)
+
+        end, err := terraformConfig(*demo)
+        if err != nil {
+            return demo, fmt.Errorf("Failed to generate terraform config: %s", err)
+        }
+
+        fd, err := os.OpenFile(filepath.Join(dstDir, "plan.tf"), os.O_WRONLY|os.O_TRUNC|os.O_CREATE, 0666)
+        if err != nil {
+            return demo, fmt.Errorf("Failed to open plan.tf: %s", err)
+        }
+        defer fd.Close()
+
+        fmt.Fprintf(fd, "%s\n%s", terraformBegin, end)
+
+        job.Log().Info("Running Terraform to configure the firewall")
+        if err = job.Run(StageInit, c.Terraform, "init"); err != nil {
+            return demo, fmt.Errorf("Failed to run terraform init: %s", err)
+        }
+        if err = job.Run(StagePlan, c.Terraform, "plan", "-no-color"); err != nil {
+            return demo, fmt.Errorf("Failed to run terraform plan: %s", err)
+        }
+        if planOnly {
+            return demo, nil
+        }
+        if err = job.Run(StageApply, c.Terraform, "apply", "-auto-approve"); err != nil {
+            return demo, fmt.Errorf("Failed to run terraform apply: %s", err)
+        }
+        // Tag the firewall commit with the git commit it came from.
+        comment := fmt.Sprintf("%s (%s)", job.Message, job.Sha[:7])
+        if err = job.Run(StageCommit, c.Commit, "-c", comment); err != nil {
+            return demo, fmt.Errorf("Failed to commit: %s", err)
+        }
+    } else {
+        return demo, fmt.Errorf("Unknown demo method: %s", demo.Method)
+    }
+
+    return demo, nil
+}
+
+// AddressChange is how one address or address group differs between two
+// demo configs.  Before and After are their descriptions.
+type AddressChange struct {
+    Name string
+    Action string
+    Before string
+    After string
+}
+
+// diffAddresses compares the addresses and address groups of two demo
+// configs by name.  Addresses and groups share names, so one can replace the
+// other.
+func diffAddresses(before, after *DemoConfig) []AddressChange {
+    describe := func(dc *DemoConfig) ([]string, map[string]string) {
+        names := make([]string, 0)
+        ans := make(map[string]string)
+        if dc == nil {
+            return names, ans
+        }
+        for _, a := range dc.Addresses {
+            names = append(names, a.Name)
+            ans[a.Name] = a.Describe()
+        }
+        for _, g := range dc.AddressGroups {
+            names = append(names, g.Name)
+            ans[g.Name] = g.Describe()
+        }
+        return names, ans
+    }
+    oldNames, old := describe(before)
+    newNames, cur := describe(after)
+
+    ans := make([]AddressChange, 0)
+    for _, name := range newNames {
+        if b, ok := old[name]; !ok {
+            ans = append(ans, AddressChange{Name: name, Action: "added", After: cur[name]})
+        } else if b != cur[name] {
+            ans = append(ans, AddressChange{Name: name, Action: "changed", Before: b, After: cur[name]})
+        }
+    }
+    for _, name := range oldNames {
+        if _, ok := cur[name]; !ok {
+            ans = append(ans, AddressChange{Name: name, Action: "removed", Before: old[name]})
+        }
+    }
+
+    return ans
+}
+
+// ServiceChange is how one app differs between two demo configs.
+type ServiceChange struct {
+    Name string
+    Action string
+    Before *DemoService
+    After *DemoService
+}
+
+// diffServices compares the apps of two demo configs by name.
+func diffServices(before, after []DemoService) []ServiceChange {
+    ans := make([]ServiceChange, 0)
+
+    old := make(map[string]*DemoService, len(before))
+    for i := range before {
+        old[before[i].Name] = &before[i]
+    }
+    seen := make(map[string]bool, len(after))
+
+    for i := range after {
+        a := &after[i]
+        seen[a.Name] = true
+        if b, ok := old[a.Name]; !ok {
+            ans = append(ans, ServiceChange{Name: a.Name, Action: "added", After: a})
+        } else if a.Describe() != b.Describe() || a.Rule().Describe() != b.Rule().Describe() {
+            ans = append(ans, ServiceChange{Name: a.Name, Action: "changed", Before: b, After: a})
+        }
+    }
+
+    for i := range before {
+        if !seen[before[i].Name] {
+            ans = append(ans, ServiceChange{Name: before[i].Name, Action: "removed", Before: &before[i]})
+        }
+    }
+
+    return ans
+}
+
+// planComment renders the pull request comment for a plan job.
+func planComment(job *Job, base, demo *DemoConfig, output string, err error) string {
+    var b bytes.Buffer
+
+    s := job.Status(false)
+    b.WriteString(fmt.Sprintf("#### Firewall plan for %s", job.Sha[:7]))
+    if s.Method != "" {
+        b.WriteString(fmt.Sprintf(" (%s)", s.Method))
+    }
+    b.WriteString("\n\n")
+
+    if err != nil {
+        b.WriteString(fmt.Sprintf("**%s failed:** %s\n\n", stageLabel(s.Method, s.Stage), err))
+    }
+
+    if demo != nil {
+        var before []DemoService
+        if base != nil {
+            before = base.Services
+        }
+        addrs := diffAddresses(base, demo)
+        changes := diffServices(before, demo.Services)
+        if len(addrs) == 0 && len(changes) == 0 {
+            b.WriteString("No changes to addresses, services or security rules.\n\n")
+        }
+
+        // Rules refer to addresses by name, so a changed address changes
+        // what the rules using it match without the rules changing.
+        if len(addrs) != 0 {
+            counts := make(map[string]int)
+            b.WriteString("| Address | Change | Rules using it |\n|---|---|---|\n")
+            for _, c := range addrs {
+                counts[c.Action]++
+                users := demo.UsedBy(c.Name)
+                if c.Action == "removed" && base != nil {
+                    users = base.UsedBy(c.Name)
+                }
+                rules := make([]string, len(users))
+                for i, u := range users {
+                    rules[i] = fmt.Sprintf("`Allow %s`", u)
+                }
+
+                change := fmt.Sprintf("%s: %s", c.Action, c.After)
+                if c.Action == "changed" {
+                    change = fmt.Sprintf("changed: %s → %s", c.Before, c.After)
+                } else if c.Action == "removed" {
+                    change = fmt.Sprintf("removed: %s", c.Before)
+                }
+                b.WriteString(fmt.Sprintf("| `%s` | %s | %s |\n", c.Name, change, strings.Join(rules, ", ")))
+            }
+            b.WriteString(fmt.Sprintf("\n%d added, %d changed, %d removed.\n\n", counts["added"], counts["changed"], counts["removed"]))
+        }
+
+        if len(changes) != 0 {
+            // Security rules reference services by name, so an app's rule
+            // only changes if what it matches does.
+            counts := make(map[string]int)
+            b.WriteString("| App | Service | Security rule |\n|---|---|---|\n")
+            for _, c := range changes {
+                counts[c.Action]++
+                switch c.Action {
+                case "added":
+                    b.WriteString(fmt.Sprintf("| `%s` | added: %s | added: `Allow %s` |\n", c.Name, c.After.Describe(), c.Name))
+                case "changed":
+                    svc, rule := "unchanged", "unchanged"
+                    if before, after := c.Before.Describe(), c.After.Describe(); before != after {
+                        svc = fmt.Sprintf("changed: %s → %s", before, after)
+                    }
+                    if before, after := c.Before.Rule().Describe(), c.After.Rule().Describe(); before != after {
+                        rule = fmt.Sprintf("changed: %s → %s", before, after)
+                    }
+                    b.WriteString(fmt.Sprintf("| `%s` | %s | %s |\n", c.Name, svc, rule))
+                case "removed":
+                    b.WriteString(fmt.Sprintf("| `%s` | removed: %s | removed: `Allow %s` |\n", c.Name, c.Before.Describe(), c.Name))
+                }
+            }
+            b.WriteString(fmt.Sprintf("\n%d added, %d changed, %d removed.\n\n", counts["added"], counts["changed"], counts["removed"]))
+        }
+    }
+
+    if output != "" {
+        if len(output) > MaxCommentOutput {
+            output = "...\n" + output[len(output) - MaxCommentOutput:]
+        }
+        b.WriteString(fmt.Sprintf("<details><summary>%s output</summary>\n\n```\n%s\n```\n\n</details>\n", stageLabel(s.Method, s.Stage), strings.TrimSpace(output)))
+    }
+
+    return b.String()
+}
+
+// stageLabel names a pipeline stage the way it appears in commit statuses,
+// e.g. "terraform apply".
+func stageLabel(method, stage string) string {
+    switch stage {
+    case StagePull:
+        return "git checkout"
+    case StageRender:
+        return "config render"
+    case StageCommit:
+        return "firewall commit"
+    case "":
+        return "deployment"
+    }
+
+    if method == "ansible" {
+        return "ansible-playbook"
+    } else if method != "" {
+        return fmt.Sprintf("%s %s", method, stage)
+    }
+    return stage
+}
+
+// setCommitStatus reports the job's state on its commit through the job's
+// provider, linking back to the job status API.  Statuses are only sent if an
+// API token is configured.
+func setCommitStatus(job *Job, state, description string) {
+    if job.Config().GitHubToken == "" {
+        return
+    }
+
+    var target string
+    if config.PublicUrl != "" {
+        target = fmt.Sprintf("%s/api/jobs/%s", strings.TrimSuffix(config.PublicUrl, "/"), job.Id)
+    }
+
+    if err := providers[job.Provider].SetStatus(job, state, description, target); err != nil {
+        job.Log().Error("Failed to set commit status", "state", state, "err", err)
+    }
+}
+
+// githubApi sends a POST to a GitHub style API.
+func githubApi(c *HookConfig, provider, endpoint string, v interface{}) error {
+    h := http.Header{}
+    h.Set("Authorization", "token "+c.GitHubToken)
+    h.Set("Accept", "application/vnd.github.v3+json")
+    return apiPost(c, provider, endpoint, h, v)
+}
+
+// gitlabApi sends a POST to the GitLab API.
+func gitlabApi(c *HookConfig, endpoint string, v interface{}) error {
+    h := http.Header{}
+    h.Set("PRIVATE-TOKEN", c.GitHubToken)
+    return apiPost(c, "gitlab", endpoint, h, v)
+}
+
+// apiPost sends a JSON POST to the provider's API.  The API is at the
+// tenant's github_api_url, or the provider's public instance if unset.
+func apiPost(c *HookConfig, provider, endpoint string, h http.Header, v interface{}) error {
+    if c.GitHubToken == "" {
+        return fmt.Errorf("No github_token configured")
+    }
+
+    base := c.GitHubApiUrl
+    if base == "" {
+        base = defaultApiUrls[provider]
+    }
+    if base == "" {
+        return fmt.Errorf("No github_api_url configured for %s", provider)
+    }
+
+    body, err := json.Marshal(v)
+    if err != nil {
+        return err
+    }
+
+    req, err := http.NewRequest(http.MethodPost, strings.TrimSuffix(base, "/")+endpoint, bytes.NewReader(body))
+    if err != nil {
+        return err
+    }
+    req.Header = h
+    req.Header.Set("Content-Type", "application/json")
+
+    resp, err := apiClient.Do(req)
+    if err != nil {
+        return err
+    }
+    defer resp.Body.Close()
+
+    if resp.StatusCode < 200 || resp.StatusCode > 299 {
+        msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+        return fmt.Errorf("POST %s: %s: %s", endpoint, resp.Status, bytes.TrimSpace(msg))
+    }
+
+    return nil
+}
+
+// handleJobs serves /api/jobs, listing the most recent jobs of the tenants
+// the caller has access to.
+func handleJobs(w http.ResponseWriter, r *http.Request) {
+    if r.Method != http.MethodGet {
+        http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+        return
+    }
+    allowed := apiTenants(r)
+    if len(allowed) == 0 {
+        http.Error(w, "Unauthorized", http.StatusUnauthorized)
+        return
+    }
+
+    // Jobs can be limited to those of one tenant.
+    tenant := r.URL.Query().Get("tenant")
+
+    list := jobs.List()
+    ans := make([]JobStatus, 0, len(list))
+    for _, job := range list {
+        if allowed[job.Tenant] && (tenant == "" || job.Tenant == tenant) {
+            ans = append(ans, job.Status(false))
+        }
+    }
+
+    writeJson(w, http.StatusOK, ans)
+}
+
+// handleJob serves /api/jobs/{id}, including the job's subprocess output,
+// and /api/jobs/{id}/cancel.
+func handleJob(w http.ResponseWriter, r *http.Request) {
+    id := strings.TrimPrefix(r.URL.Path, "/api/jobs/")
+    if strings.HasSuffix(id, "/cancel") {
+        handleCancel(w, r, strings.TrimSuffix(id, "/cancel"))
+        return
+    }
+
+    if r.Method != http.MethodGet {
+        http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+        return
+    } else if id == "" {
+        handleJobs(w, r)
+        return
+    }
+    allowed := apiTenants(r)
+    if len(allowed) == 0 {
+        http.Error(w, "Unauthorized", http.StatusUnauthorized)
+        return
+    }
+
+    // Other tenants' jobs are as good as missing.
+    job := jobs.Get(id)
+    if job == nil || !allowed[job.Tenant] {
+        http.Error(w, "No such job", http.StatusNotFound)
+        return
+    }
+
+    writeJson(w, http.StatusOK, job.Status(true))
+}
+
+// handleCancel cancels a queued or running job.
+func handleCancel(w http.ResponseWriter, r *http.Request, id string) {
+    if r.Method != http.MethodPost {
+        http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+        return
+    }
+    allowed := apiTenants(r)
+    if len(allowed) == 0 {
+        slog.Warn("Rejecting cancel request", "remote", r.RemoteAddr)
+        http.Error(w, "Unauthorized", http.StatusUnauthorized)
+        return
+    }
+
+    job := jobs.Get(id)
+    if job == nil || !allowed[job.Tenant] {
+        http.Error(w, "No such job", http.StatusNotFound)
+        return
+    }
+    if err := job.Cancel(); err != nil {
+        http.Error(w, err.Error(), http.StatusConflict)
+        return
+    }
+
+    writeJson(w, http.StatusAccepted, map[string]string{"id": job.Id})
+}
+
+// handleMetrics serves /metrics for Prometheus.
+func handleMetrics(w http.ResponseWriter, r *http.Request) {
+    if r.Method != http.MethodGet {
+        http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+        return
+    }
+
+    w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+    depths := make(map[string]int, len(tenants))
+    for name, t := range tenants {
+        depths[name] = t.Queue.Depth()
+    }
+    metrics.Write(w, depths)
+}
+
+// handleHealthz serves /healthz, which only reports that las is running.
+func handleHealthz(w http.ResponseWriter, r *http.Request) {
+    fmt.Fprintf(w, "ok\n")
+}
+
+// Readiness is the body of a /readyz response.
+type Readiness struct {
+    Ready bool `json:"ready"`
+    Tenants map[string]FirewallStatus `json:"tenants"`
+}
+
+// handleReadyz serves /readyz, which reports ready once every tenant's
+// firewall is up and accepts its credentials.
+func handleReadyz(w http.ResponseWriter, r *http.Request) {
+    ans := Readiness{Ready: true, Tenants: make(map[string]FirewallStatus, len(tenants))}
+    for name, t := range tenants {
+        s := t.Firewall.Status()
+        ans.Tenants[name] = s
+        ans.Ready = ans.Ready && s.Ready
+    }
+
+    if !ans.Ready {
+        writeJson(w, http.StatusServiceUnavailable, ans)
+        return
+    }
+    writeJson(w, http.StatusOK, ans)
+}
+
+func writeJson(w http.ResponseWriter, code int, v interface{}) {
+    w.Header().Set("Content-Type", "application/json")
+    w.WriteHeader(code)
+    json.NewEncoder(w).Encode(v)
+}
+
+// terraformSourcePort is the source_port line of a service object, if it has
+// source ports.
+func terraformSourcePort(o ServiceObject) string {
+    if o.SourcePorts == "" {
+        return ""
+    }
+    return fmt.Sprintf("    source_port = \"%s\"\n", o.SourcePorts)
+}
+
+// terraformList renders strings as the elements of a Terraform list.
+func terraformList(vals []string) string {
+    ans := make([]string, len(vals))
+    for i, v := range vals {
+        ans[i] = fmt.Sprintf("\"%s\"", v)
+    }
+    return strings.Join(ans, ", ")
+}
+
+// terraformRefs is terraformList for names that may be of resources in the
+// plan, which are referred to by their resources so that Terraform creates
+// them first.
+func terraformRefs(vals []string, refs map[string]string) string {
+    ans := make([]string, len(vals))
+    for i, v := range vals {
+        if ref, ok := refs[v]; ok {
+            ans[i] = ref
+        } else {
+            ans[i] = fmt.Sprintf("\"%s\"", v)
+        }
+    }
+    return strings.Join(ans, ", ")
+}
+
+// terraformZones is terraformRefs for zones, some of which the template
+// creates.
+func terraformZones(zones []string) string {
+    return terraformRefs(zones, map[string]string{UntrustZone: "panos_zone.zut.name", TrustZone: "panos_zone.zt.name"})
+}
+
+func terraformConfig(dc DemoConfig) (string, error) {
+    var b bytes.Buffer
+    var b2 bytes.Buffer
+
+    // Addresses and groups are referred to by their resources.
+    addrs := make(map[string]string, len(dc.Addresses) + len(dc.AddressGroups))
+    for i, a := range dc.Addresses {
+        b.WriteString(fmt.Sprintf(`
+resource "panos_address_object" "ao%d" {
+    name = "%s"
+    description = "Corporate application address"
+    type = "%s"
+    value = "%s"
+}
+`, i, a.Name, a.Type(), a.Value()))
+        addrs[a.Name] = fmt.Sprintf("panos_address_object.ao%d.name", i)
+    }
+    for i, g := range dc.AddressGroups {
+        members := fmt.Sprintf("    dynamic_match = \"%s\"\n", g.Dynamic)
+        if len(g.Static) != 0 {
+            members = fmt.Sprintf("    static_addresses = [%s]\n", terraformRefs(g.Static, addrs))
+        }
+        b.WriteString(fmt.Sprintf(`
+resource "panos_address_group" "ag%d" {
+    name = "%s"
+    description = "Corporate application addresses"
+%s}
+`, i, g.Name, members))
+        addrs[g.Name] = fmt.Sprintf("panos_address_group.ag%d.name", i)
+    }
+
+    b2.WriteString("\nresource \"panos_security_policies\" \"sec_rules\"{\n")
+
+    for i, svc := range dc.Services {
+        // An app with both TCP and UDP ports gets a service object for each,
+        // joined in a service group that the rule allows.
+        ref := fmt.Sprintf("panos_service_object.so%d.name", i)
+        objs := svc.Objects()
+        for _, o := range objs {
+            id := fmt.Sprintf("so%d", i)
+            if svc.IsGroup() {
+                id = fmt.Sprintf("so%d_%s", i, o.Protocol)
+            }
+            b.WriteString(fmt.Sprintf(`
+resource "panos_service_object" "%s" {
+    name = "%s"
+    description = "Corporate application service"
+    protocol = "%s"
+%s    destination_port = "%s"
+}
+`, id, o.Name, o.Protocol, terraformSourcePort(o), o.Ports))
+        }
+        if svc.IsGroup() {
+            refs := make([]string, len(objs))
+            for j, o := range objs {
+                refs[j] = fmt.Sprintf("panos_service_object.so%d_%s.name", i, o.Protocol)
+            }
+            b.WriteString(fmt.Sprintf(`
+resource "panos_service_group" "sg%d" {
+    name = "%s"
+    services = [%s]
+}
+`, i, svc.Name, strings.Join(refs, ", ")))
+            ref = fmt.Sprintf("panos_service_group.sg%d.name", i)
+        } else if svc.Service == ApplicationDefault {
+            ref = fmt.Sprintf("\"%s\"", ApplicationDefault)
+        }
+
+        rule := svc.Rule()
+        b2.WriteString(fmt.Sprintf(`
+    rule {
+        name = "Allow %s"
+        source_zones = [%s]
+        source_addresses = [%s]
+        negate_source = %t
+        source_users = ["any"]
+        hip_profiles = ["any"]
+        destination_zones = [%s]
+        destination_addresses = [%s]
+        negate_destination = %t
+        applications = [%s]
+        services = [%s]
+        categories = ["any"]
+        action = "allow"
+    }`, svc.Name, terraformZones(rule.SourceZones), terraformRefs(rule.SourceAddresses, addrs), rule.NegateSource, terraformZones(rule.DestinationZones), terraformRefs(rule.DestinationAddresses, addrs), rule.NegateDestination, terraformList(rule.Applications), ref))
+    }
+
+    b2.WriteString(`
+    rule {
+        name = "Deny everything else"
+        source_zones = ["any"]
+        source_addresses = ["any"]
+        source_users = ["any"]
+        hip_profiles = ["any"]
+        destination_zones = ["any"]
+        destination_addresses = ["any"]
+        applications = ["any"]
+        services = ["application-default"]
+        categories = ["any"]
+        action = "deny"
+    }
+}
+`)
+
+    return b.String() + "\n" + b2.String(), nil
+}
+
+// ansibleSourcePort is the source_port line of a service object task, if it
+// has source ports.
+func ansibleSourcePort(o ServiceObject) string {
+    if o.SourcePorts == "" {
+        return ""
+    }
+    return fmt.Sprintf("      source_port: '%s'\n", o.SourcePorts)
+}
+
+// ansibleList renders strings as the elements of a YAML flow sequence.
+func ansibleList(vals []string) string {
+    ans := make([]string, len(vals))
+    for i, v := range vals {
+        ans[i] = fmt.Sprintf("'%s'", v)
+    }
+    return strings.Join(ans, ", ")
+}
+
+func ansibleConfig(dc DemoConfig) (string, error) {
+    var b bytes.Buffer
+
+    /*
+    var err error
+
+    if fw.ApiKey == "" {
+        if err = fw.Initialize(); err != nil {
+            return "", err
+        }
+    }
+
+    services, err := fw.Objects.Services.GetList("")
+    if err != nil {
+        return "", err
+    }
+
+    policies, err := fw.Policies.Security.GetList("")
+    if err != nil {
+        return "", err
+    }
+
+    // Remove all policies.
+    for _, p := range policies {
+        b.WriteString(fmt.Sprintf(`
+  - name: "Removing security policy %s"
+    panos_security_rule:
+      provider: '{{ provider }}'
+      state: 'absent'
+      rule_name: '%s'
+`, p, p))
+    }
+
+    // Remove all services.
+    for _, s := range services {
+        b.WriteString(fmt.Sprintf(`
+  - name: "Removing service %s"
+    panos_service_object:
+      provider: '{{ provider }}'
+      state: 'absent'
+      commit: false
+      name: '%s'
+`, s, s))
+    }
+    */
+
+    // Build config to add back in, starting with the addresses the rules
+    // refer to.
+    for _, a := range dc.Addresses {
+        b.WriteString(fmt.Sprintf(`
+  - name: "Add address %s"
+    panos_address_object:
+      provider: '{{ provider }}'
+      name: '%s'
+      description: 'Corporate application address'
+      address_type: '%s'
+      value: '%s'
+      commit: false
+`, a.Name, a.Name, a.Type(), a.Value()))
+    }
+    for _, g := range dc.AddressGroups {
+        members := fmt.Sprintf("      dynamic_value: \"%s\"\n", g.Dynamic)
+        if len(g.Static) != 0 {
+            members = fmt.Sprintf("      static_value: [%s]\n", ansibleList(g.Static))
+        }
+        b.WriteString(fmt.Sprintf(`
+  - name: "Add address group %s"
+    panos_address_group:
+      provider: '{{ provider }}'
+      name: '%s'
+      description: 'Corporate application addresses'
+%s      commit: false
+`, g.Name, g.Name, members))
+    }
+
+    for _, s := range dc.Services {
+        objs := s.Objects()
+        for _, o := range objs {
+            b.WriteString(fmt.Sprintf(`
+  - name: "Add service %s"
+    panos_service_object:
+      provider: '{{ provider }}'
+      name: '%s'
+      description: 'Corporate application service'
+%s      destination_port: '%s'
+      protocol: '%s'
+      commit: false
+`, o.Name, o.Name, ansibleSourcePort(o), o.Ports, o.Protocol))
+        }
+        if s.IsGroup() {
+            names := make([]string, len(objs))
+            for i, o := range objs {
+                names[i] = fmt.Sprintf("'%s'", o.Name)
+            }
+            b.WriteString(fmt.Sprintf(`
+  - name: "Add service group %s"
+    panos_service_group:
+      provider: '{{ provider }}'
+      name: '%s'
+      value: [%s]
+      commit: false
+`, s.Name, s.Name, strings.Join(names, ", ")))
+        }
+
+        rule := s.Rule()
+        b.WriteString(fmt.Sprintf(`
+  - name: "Add security rule for %s"
+    panos_security_rule:
+      provider: '{{ provider }}'
+      rule_name: 'Allow %s'
+      description: 'Allow corporate app'
+      source_zone: [%s]
+      source_ip: [%s]
+      negate_source: %t
+      destination_zone: [%s]
+      destination_ip: [%s]
+      negate_destination: %t
+      application: [%s]
+      service: ['%s']
+      action: 'allow'
+      commit: False
+`, s.Name, s.Name, ansibleList(rule.SourceZones), ansibleList(rule.SourceAddresses), rule.NegateSource, ansibleList(rule.DestinationZones), ansibleList(rule.DestinationAddresses), rule.NegateDestination, ansibleList(rule.Applications), s.ServiceName()))
+    }
+
+    // Add in deny all security policy.
+    b.WriteString(`
+  - name: "Add Deny All security policy and commit"
+    panos_security_rule:
+      provider: '{{ provider }}'
+      rule_name: 'Deny everything else'
+      action: 'deny'
+      location: 'bottom'
+      commit: True
+`)
+
+    // Done!
+    return b.String(), nil
+}
+
+// checkout fetches the account's repo and checks out the job's commit into a
+// fresh, detached worktree, returning the worktree's path.
+func checkout(job *Job) (string, error) {
+    var err error
+
+    repoDir := job.Config().RepoDir()
+    worktree := fmt.Sprintf("%s/las-%s", os.TempDir(), job.Id)
+
+    if err = job.Run(StagePull, "git", "-C", repoDir, "fetch", "--prune", "--tags", "origin"); err != nil {
+        return "", fmt.Errorf("git fetch failed: %s", err)
+    }
+    if job.FetchRef != "" {
+        // Pull request heads may live in forks, so fetch the provider's copy.
+        if err = job.Run(StagePull, "git", "-C", repoDir, "fetch", "origin", job.FetchRef); err != nil {
+            return "", fmt.Errorf("git fetch of %s failed: %s", job.FetchRef, err)
+        }
+    }
+    if err = job.Run(StagePull, "git", "-C", repoDir, "worktree", "prune"); err != nil {
+        return "", fmt.Errorf("git worktree prune failed: %s", err)
+    }
+    if err = job.Run(StagePull, "git", "-C", repoDir, "worktree", "add", "--detach", worktree, job.Sha); err != nil {
+        return "", fmt.Errorf("Failed to check out %s: %s", job.Sha, err)
+    }
+
+    return worktree, nil
+}
+
+// removeWorktree removes a worktree created by checkout.
+func removeWorktree(job *Job, worktree string) {
+    ctx, cancel := context.WithTimeout(context.Background(), stageTimeout(StagePull))
+    defer cancel()
+
+    cmd := command(ctx, "git", "-C", job.Config().RepoDir(), "worktree", "remove", "--force", worktree)
+    cmd.Stdout, cmd.Stderr = job, job
+    if err := cmd.Run(); err != nil {
+        job.Log().Warn("Failed to remove worktree", "worktree", worktree, "err", err)
+    }
+}
+
+// baseDemoConfig reads settings.json as of a plan job's base revision.
+func baseDemoConfig(job *Job) (*DemoConfig, error) {
+    ctx, cancel := context.WithTimeout(context.Background(), stageTimeout(StagePull))
+    defer cancel()
+
+    body, err := command(ctx, "git", "-C", job.Config().RepoDir(), "show", job.Base+":settings.json").Output()
+    if err != nil {
+        return nil, fmt.Errorf("Failed to read settings.json at %s: %s", job.Base, err)
+    }
+
+    demo := DemoConfig{}
+    if err = json.Unmarshal(body, &demo); err != nil {
+        return nil, fmt.Errorf("Failed to parse demo config at %s: %s", job.Base, err)
+    }
+
+    return &demo, nil
+}
+
+// RepoName is the full name of the repo to accept events from.
+func (c *HookConfig) RepoName() string {
+    if c.Repo != "" {
+        return c.Repo
+    }
+    return fmt.Sprintf("HookOrg/%s", c.GitHubAccount)
+}
+
+// RepoDir is the local clone of the account's HookOrg repo.
+func (c *HookConfig) RepoDir() string {
+    return fmt.Sprintf("%s/%s", c.BaseDir, c.GitHubAccount)
+}
+
+func copyAllFiles(c *HookConfig) error {
+    var err error
+
+    slog.Info("Copying files into place")
+
+    if err = copyFiles(fmt.Sprintf("%s/anchor", c.DemoDir), fmt.Sprintf("%s/anchor", c.BaseDir)); err != nil {
+        return err
+    }
+
+    if err = copyFiles(fmt.Sprintf("%s/tricky", c.DemoDir), fmt.Sprintf("%s/tricky", c.BaseDir)); err != nil {
+        return err
+    }
+
+    return nil
+}
+
+func copyFiles(src, dst string) error {
+    files, err := ioutil.ReadDir(src)
+    if err != nil {
+        return fmt.Errorf("Error listing dir contents: %s", err)
+    }
+
+    for _, fi := range files {
+        if fi.IsDir() {
+            continue
+        }
+        sfd, err := os.Open(fmt.Sprintf("%s/%s", src, fi.Name()))
+        if err != nil {
+            return fmt.Errorf("Failed to open src %q: %s", fi.Name(), err)
+        }
+        defer sfd.Close()
+
+        data, err := ioutil.ReadAll(sfd)
+        if err != nil {
+            return fmt.Errorf("Failed readall of %q: %s", fi.Name(), err)
+        }
+
+        dfd, err := os.OpenFile(fmt.Sprintf("%s/%s", dst, fi.Name()), os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+        if err != nil {
+            return fmt.Errorf("Failed to open dst %q: %s", fi.Name(), err)
+        }
+        defer dfd.Close()
+
+        fmt.Fprintf(dfd, "%s", data)
+    }
+
+    return nil
+}
+
+func loadDemoConfig(dir, defaultExec string) (*DemoConfig, error) {
+    var err error
+
+    // Read the config from the repo.
+    slog.Debug("Reading settings.json", "dir", dir)
+    fd, err := os.Open(fmt.Sprintf("%s/settings.json", dir))
+    if err != nil {
+        return nil, fmt.Errorf("Failed to open settings.json: %s", err)
+    }
+    defer fd.Close()
+
+    body, err := ioutil.ReadAll(fd)
+    if err != nil {
+        return nil, fmt.Errorf("Failed to read settings.json: %s", err)
+    }
+
+    demo := DemoConfig{Method: defaultExec}
+    if err = json.Unmarshal(body, &demo); err != nil {
+        return nil, fmt.Errorf("Failed to parse demo config: %s", err)
+    } else if err = demo.IsValid(); err != nil {
+        return nil, err
+    }
+
+    return &demo, nil
+}
+
+// setting is a single valued config setting, which can also be given as an
+// environment variable or command line flag named after its config file key.
+type setting struct {
+    Key string
+    Secret bool
+    Value reflect.Value
+}
+
+// settings returns the single valued settings in c, a pointer to a HookConfig
+// or TenantConfig, in the order they are declared.
+func settings(c interface{}) []setting {
+    v := reflect.ValueOf(c).Elem()
+    t := v.Type()
+
+    ans := make([]setting, 0, t.NumField())
+    for i := 0; i < t.NumField(); i++ {
+        switch t.Field(i).Type.Kind() {
+        case reflect.String, reflect.Int, reflect.Bool:
+            ans = append(ans, setting{
+                Key: t.Field(i).Tag.Get("json"),
+                Secret: t.Field(i).Tag.Get("secret") == "true",
+                Value: v.Field(i),
+            })
+        }
+    }
+    return ans
+}
+
+// Set parses raw into the setting.
+func (s setting) Set(raw string) error {
+    switch s.Value.Kind() {
+    case reflect.String:
+        s.Value.SetString(raw)
+    case reflect.Int:
+        n, err := strconv.Atoi(raw)
+        if err != nil {
+            return fmt.Errorf("Invalid %s %q: not a number", s.Key, raw)
+        }
+        s.Value.SetInt(int64(n))
+    case reflect.Bool:
+        b, err := strconv.ParseBool(raw)
+        if err != nil {
+            return fmt.Errorf("Invalid %s %q: not true or false", s.Key, raw)
+        }
+        s.Value.SetBool(b)
+    }
+    return nil
+}
+
+// EnvName is the environment variable for the setting, e.g. LAS_BASE_DIR.
+func (s setting) EnvName() string {
+    return "LAS_" + strings.ToUpper(s.Key)
+}
+
+// FlagName is the command line flag for the setting, e.g. -base-dir.
+func (s setting) FlagName() string {
+    return strings.ReplaceAll(s.Key, "_", "-")
+}
+
+// settingFlag collects a setting given on the command line, so it can be
+// applied after the config file and environment.
+type settingFlag struct {
+    key string
+    isBool bool
+    given map[string]string
+}
+
+func (f *settingFlag) String() string {
+    return ""
+}
+
+func (f *settingFlag) Set(v string) error {
+    f.given[f.key] = v
+    return nil
+}
+
+func (f *settingFlag) IsBoolFlag() bool {
+    return f.isBool
+}
+
+// loadConfig returns the effective config.  Each setting comes from, in
+// increasing order of precedence: its default, the config file, its LAS_*
+// environment variable and its command line flag.
+func loadConfig(name string, args []string) (HookConfig, error) {
+    c, err := readConfig(name, args)
+    if err != nil {
+        return c, err
+    }
+    return c, validateConfig(&c)
+}
+
+// readConfig is loadConfig without the validation.
+func readConfig(name string, args []string) (HookConfig, error) {
+    var err error
+
+    c := HookConfig{}
+    given := make(map[string]string)
+
+    fs := flag.NewFlagSet(name, flag.ContinueOnError)
+    file := fs.String("config", DefaultConfigFile, "The config file (or LAS_CONFIG)")
+    for _, s := range settings(&c) {
+        f := &settingFlag{key: s.Key, isBool: s.Value.Kind() == reflect.Bool, given: given}
+        fs.Var(f, s.FlagName(), fmt.Sprintf("Sets %q (or %s)", s.Key, s.EnvName()))
+    }
+    if err = fs.Parse(args); err != nil {
+        return c, err
+    } else if fs.NArg() > 0 {
+        return c, fmt.Errorf("Unexpected arguments: %s", strings.Join(fs.Args(), " "))
+    }
+
+    // A missing config file is fine unless one was asked for.
+    path, explicit := *file, false
+    fs.Visit(func(f *flag.Flag) {
+        explicit = explicit || f.Name == "config"
+    })
+    if v := os.Getenv("LAS_CONFIG"); v != "" && !explicit {
+        path, explicit = v, true
+    }
+    body, err := ioutil.ReadFile(path)
+    if err == nil {
+        if err = json.Unmarshal(body, &c); err != nil {
+            return c, fmt.Errorf("Invalid config file %s: %s", path, err)
+        }
+    } else if explicit || !os.IsNotExist(err) {
+        return c, err
+    }
+
+    for _, s := range settings(&c) {
+        if v, ok := os.LookupEnv(s.EnvName()); ok {
+            if err = s.Set(v); err != nil {
+                return c, fmt.Errorf("%s: %s", s.EnvName(), err)
+            }
+        }
+    }
+    for _, s := range settings(&c) {
+        if v, ok := given[s.Key]; ok {
+            if err = s.Set(v); err != nil {
+                return c, fmt.Errorf("-%s: %s", s.FlagName(), err)
+            }
+        }
+    }
+
+    applyDefaults(&c)
+    return c, nil
+}
+
+// applyDefaults fills in the settings that weren't given.  Most paths default
+// to somewhere in base_dir.
+func applyDefaults(c *HookConfig) {
+    setDefault := func(v *string, def string) {
+        if *v == "" {
+            *v = def
+        }
+    }
+
+    setDefault(&c.BaseDir, DefaultBaseDir)
+    setDefault(&c.DemoDir, filepath.Join(c.BaseDir, RepoName))
+    setDefault(&c.AnsiblePlaybook, DefaultAnsiblePlaybook)
+    setDefault(&c.Terraform, filepath.Join(c.BaseDir, "bin", "terraform"))
+    setDefault(&c.Commit, filepath.Join(c.BaseDir, "bin", "commit"))
+    setDefault(&c.LedgerFile, filepath.Join(c.BaseDir, "las-ledger.json"))
+    setDefault(&c.QueueFile, filepath.Join(c.BaseDir, "las-queue.json"))
+    setDefault(&c.JobLogDir, filepath.Join(c.BaseDir, "las-jobs"))
+    setDefault(&c.SecretKeyFile, filepath.Join(c.BaseDir, "las-secret.key"))
+    setDefault(&c.Provider, "github")
+    setDefault(&c.Listen, DefaultListen)
+    setDefault(&c.LogFile, DefaultLogFile)
+    setDefault(&c.LogFormat, "text")
+
+    // Leaving out a log rotation limit gets the default; a negative one turns
+    // that kind of rotation off.
+    if c.LogMaxSize == 0 {
+        c.LogMaxSize = DefaultLogMaxSize
+    }
+    if c.LogMaxAge == 0 {
+        c.LogMaxAge = DefaultLogMaxAge
+    }
+    if c.LogKeep == 0 {
+        c.LogKeep = DefaultLogKeep
+    }
+    if c.ShutdownTimeout <= 0 {
+        c.ShutdownTimeout = int(DefaultShutdownTimeout / time.Second)
+    }
+}
+
+// tenantConfigs returns each tenant's effective config: its own settings,
+// with the rest inherited from c.  Tenants keep their ledger and queue in
+// their own base_dir.  Without any tenants configured, c is the only tenant,
+// "default".
+func tenantConfigs(c HookConfig) map[string]HookConfig {
+    if len(c.Tenants) == 0 {
+        return map[string]HookConfig{"default": c}
+    }
+
+    ans := make(map[string]HookConfig, len(c.Tenants))
+    for name, tc := range c.Tenants {
+        tenant := c
+        tenant.Tenants = nil
+
+        fields := make(map[string]setting)
+        for _, s := range settings(&tenant) {
+            fields[s.Key] = s
+        }
+        for _, s := range settings(&tc) {
+            if !s.Value.IsZero() {
+                fields[s.Key].Value.Set(s.Value)
+            }
+        }
+        if tc.Refs != nil {
+            tenant.Refs = tc.Refs
+        }
+        if tc.PlanUsers != nil {
+            tenant.PlanUsers = tc.PlanUsers
+        }
+        tenant.LedgerFile = filepath.Join(tenant.BaseDir, "las-ledger.json")
+        tenant.QueueFile = filepath.Join(tenant.BaseDir, "las-queue.json")
+
+        ans[name] = tenant
+    }
+    return ans
+}
+
+// tenantNames returns the names of the tenant configs, sorted.
+func tenantNames(tcs map[string]HookConfig) []string {
+    ans := make([]string, 0, len(tcs))
+    for name := range tcs {
+        ans = append(ans, name)
+    }
+    sort.Strings(ans)
+    return ans
+}
+
+// validateConfig checks that the effective config is usable.
+func validateConfig(c *HookConfig) error {
+    var err error
+
+    tcs := tenantConfigs(*c)
+    names := tenantNames(tcs)
+
+    baseDirs := make(map[string]string)
+    repos := make(map[string]string)
+    for _, name := range names {
+        tc := tcs[name]
+        if !tenantRe.MatchString(name) {
+            return fmt.Errorf("Invalid tenant name %q", name)
+        } else if err = validateTenant(&tc); err != nil {
+            if len(c.Tenants) == 0 {
+                return err
+            }
+            return fmt.Errorf("Tenant %q: %s", name, err)
+        }
+
+        // Tenants can't share a working directory or a repo.
+        if other, ok := baseDirs[tc.BaseDir]; ok {
+            return fmt.Errorf("Tenants %q and %q have the same base_dir", other, name)
+        } else if other, ok = repos[tc.RepoName()]; ok {
+            return fmt.Errorf("Tenants %q and %q have the same repo", other, name)
+        }
+        baseDirs[tc.BaseDir], repos[tc.RepoName()] = name, name
+    }
+
+    for stage := range c.StageTimeouts {
+        if _, ok := DefaultStageTimeouts[stage]; !ok {
+            return fmt.Errorf("Unknown stage %q in stage_timeouts", stage)
+        }
+    }
+    if c.LogFormat != "text" && c.LogFormat != "json" {
+        return fmt.Errorf("Unknown log_format %q", c.LogFormat)
+    }
+
+    return nil
+}
+
+// validateTenant checks a tenant's effective config.
+func validateTenant(c *HookConfig) error {
+    var err error
+
+    missing := []string{}
+    for _, s := range settings(c) {
+        switch s.Key {
+        case "hostname", "username", "password", "github_account", "webhook_secret":
+            if s.Value.String() == "" {
+                missing = append(missing, s.Key)
+            }
+        }
+    }
+    if len(missing) > 0 {
+        return fmt.Errorf("Missing required settings: %s", strings.Join(missing, ", "))
+    }
+
+    if _, ok := providers[c.Provider]; !ok {
+        return fmt.Errorf("Unknown provider %q", c.Provider)
+    } else if c.Exec != "" && c.Exec != "ansible" && c.Exec != "terraform" {
+        return fmt.Errorf("Unknown exec %q; only 'ansible' or 'terraform' allowed", c.Exec)
+    }
+    for _, pattern := range c.Refs {
+        if _, err = path.Match(pattern, ""); err != nil {
+            return fmt.Errorf("Invalid ref pattern %q: %s", pattern, err)
+        }
+    }
+
+    return nil
+}
+
+// redacted returns a copy of c with its secrets hidden, including those of
+// its tenants.
+func redacted(c HookConfig) HookConfig {
+    // Where a secret is kept isn't secret, unless it's a helper command,
+    // which might include a token of its own.
+    redact := func(v interface{}) {
+        for _, s := range settings(v) {
+            val := s.Value.String()
+            if s.Secret && val != "" && !strings.HasPrefix(val, "file:") && !strings.HasPrefix(val, "env:") {
+                s.Value.SetString("<redacted>")
+            }
+        }
+    }
+
+    redact(&c)
+    if c.Tenants != nil {
+        tcs := make(map[string]TenantConfig, len(c.Tenants))
+        for name, tc := range c.Tenants {
+            redact(&tc)
+            tcs[name] = tc
+        }
+        c.Tenants = tcs
+    }
+    return c
+}
+
+// resolveSecrets replaces the secret settings of the config and its tenants
+// with the secrets they refer to.
+func resolveSecrets(c *HookConfig) error {
+    resolve := func(v interface{}) error {
+        for _, s := range settings(v) {
+            if !s.Secret || s.Value.String() == "" {
+                continue
+            }
+            secret, err := resolveSecret(s.Value.String(), c.SecretKeyFile)
+            if err != nil {
+                return fmt.Errorf("%s: %s", s.Key, err)
+            }
+            s.Value.SetString(secret)
+        }
+        return nil
+    }
+
+    if err := resolve(c); err != nil {
+        return err
+    }
+
+    names := make([]string, 0, len(c.Tenants))
+    for name := range c.Tenants {
+        names = append(names, name)
+    }
+    sort.Strings(names)
+    for _, name := range names {
+        tc := c.Tenants[name]
+        if err := resolve(&tc); err != nil {
+            return fmt.Errorf("Tenant %q: %s", name, err)
+        }
+        c.Tenants[name] = tc
+    }
+
+    return nil
+}
+
+// resolveSecret returns the secret a setting refers to, which is one of:
+//
+//   file:<path>     The contents of a file.
+//   env:<name>      An environment variable.
+//   exec:<command>  The output of a helper command, run with sh -c.
+//   enc:<data>      A secret encrypted by "las secret encrypt".
+//
+// Anything else is the secret itself.
+func resolveSecret(ref, keyFile string) (string, error) {
+    var secret string
+
+    kind, arg, _ := strings.Cut(ref, ":")
+    switch kind {
+    case "file":
+        body, err := ioutil.ReadFile(arg)
+        if err != nil {
+            return "", err
+        }
+        secret = string(body)
+    case "env":
+        v, ok := os.LookupEnv(arg)
+        if !ok {
+            return "", fmt.Errorf("$%s is not set", arg)
+        }
+        secret = v
+    case "exec":
+        ctx, cancel := context.WithTimeout(context.Background(), SecretTimeout)
+        defer cancel()
+
+        var stderr bytes.Buffer
+        cmd := command(ctx, "sh", "-c", arg)
+        cmd.Stderr = &stderr
+        out, err := cmd.Output()
+        if err != nil {
+            return "", commandError("Secret helper", err, stderr.Bytes())
+        }
+        secret = string(out)
+    case "enc":
+        key, err := readSecretKey(keyFile)
+        if err != nil {
+            return "", err
+        }
+        return decryptSecret(key, arg)
+    default:
+        return ref, nil
+    }
+
+    // Files and helper output usually end with a newline that isn't part of
+    // the secret.
+    secret = strings.TrimRight(secret, "\r\n")
+    if secret == "" {
+        return "", fmt.Errorf("%s is empty", ref)
+    }
+    return secret, nil
+}
+
+// readSecretKey reads the key that "enc:" secrets are encrypted with.  Like
+// an ssh key, it must only be readable by its owner.
+func readSecretKey(path string) ([]byte, error) {
+    info, err := os.Stat(path)
+    if err != nil {
+        return nil, err
+    } else if info.Mode().Perm() & 0077 != 0 {
+        return nil, fmt.Errorf("%s must not be accessible by others (chmod 600 it)", path)
+    }
+
+    body, err := ioutil.ReadFile(path)
+    if err != nil {
+        return nil, err
+    }
+    key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(body)))
+    if err != nil || len(key) != 32 {
+        return nil, fmt.Errorf("%s is not a secret key", path)
+    }
+    return key, nil
+}
+
+// createSecretKey writes a new random key for encrypting secrets.
+func createSecretKey(path string) ([]byte, error) {
+    key := make([]byte, 32)
+    if _, err := rand.Read(key); err != nil {
+        return nil, err
+    }
+
+    fd, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+    if err != nil {
+        return nil, err
+    }
+    defer fd.Close()
+
+    if _, err = fmt.Fprintf(fd, "%s\n", base64.StdEncoding.EncodeToString(key)); err != nil {
+        return nil, err
+    }
+    return key, fd.Close()
+}
+
+// secretCipher returns the AES-256-GCM cipher for the key.
+func secretCipher(key []byte) (cipher.AEAD, error) {
+    block, err := aes.NewCipher(key)
+    if err != nil {
+        return nil, err
+    }
+    return cipher.NewGCM(block)
+}
+
+// encryptSecret encrypts a secret with the key, returning it as an "enc:"
+// reference.
+func encryptSecret(key []byte, secret string) (string, error) {
+    gcm, err := secretCipher(key)
+    if err != nil {
+        return "", err
+    }
+
+    nonce := make([]byte, gcm.NonceSize())
+    if _, err = rand.Read(nonce); err != nil {
+        return "", err
+    }
+    return "enc:" + base64.StdEncoding.EncodeToString(gcm.Seal(nonce, nonce, []byte(secret), nil)), nil
+}
+
+// decryptSecret decrypts the data of an "enc:" reference with the key.
+func decryptSecret(key []byte, data string) (string, error) {
+    gcm, err := secretCipher(key)
+    if err != nil {
+        return "", err
+    }
+
+    body, err := base64.StdEncoding.DecodeString(data)
+    if err != nil || len(body) < gcm.NonceSize() {
+        return "", fmt.Errorf("Invalid encrypted secret")
+    }
+    secret, err := gcm.Open(nil, body[:gcm.NonceSize()], body[gcm.NonceSize():], nil)
+    if err != nil {
+        return "", fmt.Errorf("Failed to decrypt secret; was it encrypted with a different key?")
+    }
+    return string(secret), nil
+}
+
+// runEncrypt implements "las secret encrypt", which reads a secret from stdin
+// and prints it encrypted, for use in config.json.  The key file is created
+// if it doesn't exist yet.
+func runEncrypt(args []string) int {
+    c, err := readConfig("las secret encrypt", args)
+    if err == flag.ErrHelp {
+        return 0
+    } else if err != nil {
+        fmt.Fprintf(os.Stderr, "%s\n", err)
+        return 2
+    }
+
+    key, err := readSecretKey(c.SecretKeyFile)
+    if os.IsNotExist(err) {
+        fmt.Fprintf(os.Stderr, "Creating secret key %s\n", c.SecretKeyFile)
+        key, err = createSecretKey(c.SecretKeyFile)
+    }
+    if err != nil {
+        fmt.Fprintf(os.Stderr, "%s\n", err)
+        return 1
+    }
+
+    body, err := ioutil.ReadAll(os.Stdin)
+    if err != nil {
+        fmt.Fprintf(os.Stderr, "%s\n", err)
+        return 1
+    }
+    secret := strings.TrimRight(string(body), "\r\n")
+    if secret == "" {
+        fmt.Fprintf(os.Stderr, "No secret given on stdin\n")
+        return 2
+    }
+
+    ans, err := encryptSecret(key, secret)
+    if err != nil {
+        fmt.Fprintf(os.Stderr, "%s\n", err)
+        return 1
+    }
+    fmt.Println(ans)
+    return 0
+}
+
+// showConfig implements "las config show", which prints the effective config
+// with secrets redacted.
+func showConfig(args []string) int {
+    c, err := loadConfig("las config show", args)
+    if err == flag.ErrHelp {
+        return 0
+    } else if err != nil {
+        fmt.Fprintf(os.Stderr, "%s\n", err)
+        return 2
+    }
+
+    enc := json.NewEncoder(os.Stdout)
+    enc.SetEscapeHTML(false)
+    enc.SetIndent("", "    ")
+    if err = enc.Encode(redacted(c)); err != nil {
+        fmt.Fprintf(os.Stderr, "%s\n", err)
+        return 1
+    }
+    return 0
+}
+
+// loadTemplates reads the beginnings of the Ansible playbook and Terraform
+// plan that deployments append to.
+func loadTemplates() error {
+    var err error
+
+    // Get the Ansible config prefix.
+    ansibleBegin, err = ioutil.ReadFile(fmt.Sprintf("%s/anchor/deploy.yml", config.DemoDir))
+    if err != nil {
+        return err
+    }
+
+    // Get the Terraform config begin.
+    terraformBegin, err = ioutil.ReadFile(fmt.Sprintf("%s/tricky/plan.tf", config.DemoDir))
+    return err
+}
+
+// newFirewall creates a pango connection to a tenant's firewall.  It isn't
+// initialized at this point because likely the firewall hasn't come up yet
+// and had the auth credentials configured; the firewall monitor does that
+// once it's up.
+func newFirewall(c *HookConfig) *pango.Firewall {
+    return &pango.Firewall{Client: pango.Client{
+        Hostname: c.Hostname,
+        Username: c.Username,
+        Password: c.Password,
+        Logging: pango.LogQuiet,
+    }}
+}
+
+// CheckResult is one line of the "las check" report.
+type CheckResult struct {
+    Name string
+    Detail string
+    Err error
+}
+
+// checkDemo is what the templates are rendered with by "las check": an address
+// of each type, a static and a dynamic address group, and apps with a service
+// object, a service group and application-default.
+var checkDemo = DemoConfig{
+    Addresses: []DemoAddress{
+        {Name: "las-check-net", IpNetmask: "192.0.2.0/24"},
+        {Name: "las-check-range", IpRange: "198.51.100.10-198.51.100.20"},
+        {Name: "las-check-host", Fqdn: "las-check.example.com"},
+    },
+    AddressGroups: []DemoAddressGroup{
+        {Name: "las-check-static", Static: []string{"las-check-net", "las-check-range"}},
+        {Name: "las-check-dynamic", Dynamic: "'las' and 'check'"},
+    },
+    Services: []DemoService{
+        {Name: "las-check", Ports: []PortSpec{"443", "8000-8100"}, SourcePorts: []PortSpec{"1024-65535"}, SourceAddresses: []string{"las-check-static", "las-check-host"}},
+        {Name: "las-check-dns", Protocol: "both", Ports: []PortSpec{"53"}, SourceAddresses: []string{"10.0.0.0/8"}, NegateSource: true},
+        {Name: "las-check-web", Service: ApplicationDefault, Applications: []string{"web-browsing", "ssl"}, DestinationAddresses: []string{"las-check-dynamic"}},
+    },
+}
+
+// runCheck implements "las check", which checks that las is ready to run:
+// the config is valid, the binaries it runs and its templates work, and the
+// firewall is reachable.  It prints a report and returns the exit code.
+func runCheck(args []string) int {
+    var err error
+
+    results := []CheckResult{}
+    add := func(name, detail string, err error) {
+        results = append(results, CheckResult{name, detail, err})
+    }
+
+    // Only the report is of interest, not the log entries along the way.
+    slog.SetDefault(slog.New(slog.NewTextHandler(io.Discard, nil)))
+
+    if config, err = loadConfig("las check", args); err == flag.ErrHelp {
+        return 0
+    }
+    var tcs map[string]HookConfig
+    detail := ""
+    if err == nil {
+        tcs = tenantConfigs(config)
+        names := tenantNames(tcs)
+        for i, name := range names {
+            c := tcs[name]
+            names[i] = fmt.Sprintf("%s (%s repo %s)", name, c.Provider, c.RepoName())
+        }
+        detail = strings.Join(names, ", ")
+    }
+    add("config", detail, err)
+    if err == nil {
+        // The firewalls can only be checked with the resolved credentials.
+        serr := resolveSecrets(&config)
+        add("secrets", "all resolved", serr)
+        tcs = nil
+        if serr == nil {
+            tcs = tenantConfigs(config)
+        }
+
+        binaries := []struct {
+            name string
+            path string
+            args []string
+        }{
+            {"git", "git", []string{"--version"}},
+            {"ansible", config.AnsiblePlaybook, []string{"--version"}},
+            {"terraform", config.Terraform, []string{"version"}},
+            {"commit", config.Commit, nil},
+        }
+        for _, b := range binaries {
+            detail, err := binaryVersion(b.path, b.args...)
+            add(b.name, detail, err)
+        }
+
+        err = loadTemplates()
+        add("templates", config.DemoDir, err)
+        if err == nil {
+            add("terraform template", "tricky/plan.tf", checkTerraformTemplate())
+            add("ansible template", "anchor/deploy.yml", checkAnsibleTemplate())
+        }
+
+        for _, name := range tenantNames(tcs) {
+            c := tcs[name]
+            m := NewFirewallMonitor(newFirewall(&c))
+            if m.check() {
+                s := m.Status()
+                add("firewall "+name, fmt.Sprintf("%s: %s running PAN-OS %s, serial %s", s.Hostname, s.Model, s.Version, s.Serial), nil)
+            } else {
+                add("firewall "+name, "", fmt.Errorf("%s: %s", c.Hostname, m.Status().Error))
+            }
+        }
+    }
+
+    failed := 0
+    for _, r := range results {
+        if r.Err != nil {
+            failed++
+            fmt.Printf("FAIL  %-20s %s\n", r.Name, r.Err)
+        } else {
+            fmt.Printf("PASS  %-20s %s\n", r.Name, r.Detail)
+        }
+    }
+    if failed > 0 {
+        fmt.Printf("\n%d of %d checks failed\n", failed, len(results))
+        return 1
+    }
+    fmt.Printf("\nAll %d checks passed\n", len(results))
+    return 0
+}
+
+// binaryVersion finds a binary and returns its path and the first line of its
+// version output.  Without args, the binary is only looked for.
+func binaryVersion(name string, args ...string) (string, error) {
+    p, err := exec.LookPath(name)
+    if err != nil {
+        return "", err
+    } else if len(args) == 0 {
+        return p, nil
+    }
+
+    ctx, cancel := context.WithTimeout(context.Background(), CheckTimeout)
+    defer cancel()
+    out, err := command(ctx, p, args...).CombinedOutput()
+    if err != nil {
+        return "", fmt.Errorf("%s %s failed: %s", p, strings.Join(args, " "), err)
+    }
+
+    version := strings.SplitN(strings.TrimSpace(string(out)), "\n", 2)[0]
+    return fmt.Sprintf("%s (%s)", p, version), nil
+}
+
+// checkTerraformTemplate renders a plan for a sample app and has terraform
+// check that it parses.
+func checkTerraformTemplate() error {
+    end, err := terraformConfig(checkDemo)
+    if err != nil {
+        return err
+    }
+
+    ctx, cancel := context.WithTimeout(context.Background(), CheckTimeout)
+    defer cancel()
+    cmd := command(ctx, config.Terraform, "fmt", "-no-color", "-")
+    cmd.Stdin = strings.NewReader(fmt.Sprintf("%s\n%s", terraformBegin, end))
+    if out, err := cmd.CombinedOutput(); err != nil {
+        return commandError("terraform fmt", err, out)
+    }
+    return nil
+}
+
+// checkAnsibleTemplate renders a playbook for a sample app and has
+// ansible-playbook check its syntax.
+func checkAnsibleTemplate() error {
+    end, err := ansibleConfig(checkDemo)
+    if err != nil {
+        return err
+    }
+
+    dir, err := ioutil.TempDir("", "las-check")
+    if err != nil {
+        return err
+    }
+    defer os.RemoveAll(dir)
+
+    if err = copyFiles(fmt.Sprintf("%s/anchor", config.DemoDir), dir); err != nil {
+        return err
+    }
+    if err = ioutil.WriteFile(filepath.Join(dir, "deploy.yml"), []byte(fmt.Sprintf("%s\n%s", ansibleBegin, end)), 0644); err != nil {
+        return err
+    }
+
+    ctx, cancel := context.WithTimeout(context.Background(), CheckTimeout)
+    defer cancel()
+    cmd := command(ctx, config.AnsiblePlaybook, "--syntax-check", "-i", "localhost,", "deploy.yml")
+    cmd.Dir = dir
+    if out, err := cmd.CombinedOutput(); err != nil {
+        return commandError("ansible-playbook --syntax-check", err, out)
+    }
+    return nil
+}
+
+// commandError describes a failed check command along with its output.
+func commandError(what string, err error, out []byte) error {
+    if msg := strings.TrimSpace(string(out)); msg != "" {
+        return fmt.Errorf("%s failed: %s: %s", what, err, msg)
+    }
+    return fmt.Errorf("%s failed: %s", what, err)
+}
+
+// RotatingLog is the main log file.  It's rotated once it grows past a
+// maximum size or has been open for longer than a maximum age, keeping a
+// limited number of old logs alongside it.
+type RotatingLog struct {
+    mu sync.Mutex
+    path string
+    maxSize int64
+    maxAge time.Duration
+    keep int
+    fd *os.File
+    size int64
+    opened time.Time
+}
+
+// OpenRotatingLog opens the log at path for appending.  A maxSize or maxAge
+// of zero or less turns off that kind of rotation.
+func OpenRotatingLog(path string, maxSize int, maxAge time.Duration, keep int) (*RotatingLog, error) {
+    l := &RotatingLog{path: path, maxSize: int64(maxSize), maxAge: maxAge, keep: keep}
+    if err := l.open(); err != nil {
+        return nil, err
+    }
+    return l, nil
+}
+
+func (l *RotatingLog) open() error {
+    fd, err := os.OpenFile(l.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+    if err != nil {
+        return err
+    }
+    info, err := fd.Stat()
+    if err != nil {
+        fd.Close()
+        return err
+    }
+
+    l.fd = fd
+    l.size = info.Size()
+    l.opened = time.Now()
+    return nil
+}
+
+// Write appends to the log, rotating it first if it's due.
+func (l *RotatingLog) Write(p []byte) (int, error) {
+    l.mu.Lock()
+    defer l.mu.Unlock()
+
+    if l.size > 0 && ((l.maxSize > 0 && l.size + int64(len(p)) > l.maxSize) || (l.maxAge > 0 && time.Since(l.opened) > l.maxAge)) {
+        if err := l.rotate(); err != nil {
+            fmt.Fprintf(os.Stderr, "Failed to rotate %s: %s\n", l.path, err)
+        }
+    }
+
+    n, err := l.fd.Write(p)
+    l.size += int64(n)
+    return n, err
+}
+
+// rotate renames the current log with a timestamp suffix, starts a new one
+// and removes the oldest logs beyond the number to keep.
+func (l *RotatingLog) rotate() error {
+    l.fd.Close()
+    rotated := fmt.Sprintf("%s.%s", l.path, time.Now().Format("20060102-150405.000"))
+    rerr := os.Rename(l.path, rotated)
+    if err := l.open(); err != nil {
+        return err
+    } else if rerr != nil {
+        return rerr
+    }
+
+    old, err := filepath.Glob(l.path + ".*")
+    if err != nil {
+        return err
+    }
+    sort.Strings(old)
+    for len(old) > l.keep {
+        os.Remove(old[0])
+        old = old[1:]
+    }
+    return nil
+}
+
+// Close closes the log.
+func (l *RotatingLog) Close() error {
+    l.mu.Lock()
+    defer l.mu.Unlock()
+    return l.fd.Close()
+}
+
+// newLogger returns a logger writing to w as logfmt ("text") or JSON.
+func newLogger(w io.Writer, format string) *slog.Logger {
+    if format == "json" {
+        return slog.New(slog.NewJSONHandler(w, nil))
+    }
+    return slog.New(slog.NewTextHandler(w, nil))
+}
+
+// fatal logs an error that las can't recover from and exits.
+func fatal(msg string, err error) {
+    slog.Error(msg, "err", err)
+    os.Exit(1)
+}
+
+// pruneJobLogs removes all but the newest keep job logs in dir.
+func pruneJobLogs(dir string, keep int) {
+    infos, err := ioutil.ReadDir(dir)
+    if err != nil {
+        slog.Warn("Failed to list job logs", "dir", dir, "err", err)
+        return
+    }
+    sort.Slice(infos, func(i, j int) bool {
+        return infos[i].ModTime().After(infos[j].ModTime())
+    })
+    for i, info := range infos {
+        if i >= keep && strings.HasSuffix(info.Name(), ".log") {
+            os.Remove(filepath.Join(dir, info.Name()))
+        }
+    }
+}
+
+// configureTls sets up the server's TLS config.  A self-signed certificate is
+// generated if requested and none exists yet, and client certificates are
+// verified against the configured CA, if any.
+func configureTls(srv *http.Server) error {
+    if config.TlsCert == "" {
+        config.TlsCert = filepath.Join(config.BaseDir, "las.crt")
+    }
+    if config.TlsKey == "" {
+        config.TlsKey = filepath.Join(config.BaseDir, "las.key")
+    }
+
+    if config.TlsSelfSigned {
+        if _, err := os.Stat(config.TlsCert); os.IsNotExist(err) {
+            slog.Info("Generating self-signed certificate", "cert", config.TlsCert)
+            if err = selfSignedCert(config.TlsCert, config.TlsKey); err != nil {
+                return err
+            }
+        }
+    }
+
+    srv.TLSConfig = &tls.Config{MinVersion: tls.VersionTLS12}
+    if config.TlsClientCa != "" {
+        caPem, err := ioutil.ReadFile(config.TlsClientCa)
+        if err != nil {
+            return fmt.Errorf("Failed to read client CA: %s", err)
+        }
+        pool := x509.NewCertPool()
+        if !pool.AppendCertsFromPEM(caPem) {
+            return fmt.Errorf("No certificates found in %q", config.TlsClientCa)
+        }
+
+        // Webhook senders don't present client certificates, so they are
+        // only required by the job API.
+        srv.TLSConfig.ClientCAs = pool
+        srv.TLSConfig.ClientAuth = tls.VerifyClientCertIfGiven
+    }
+
+    return nil
+}
+
+// selfSignedCert writes a new self-signed certificate and key, valid for the
+// public URL's host and this machine's hostname.
+func selfSignedCert(certFile, keyFile string) error {
+    key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+    if err != nil {
+        return err
+    }
+
+    serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+    if err != nil {
+        return err
+    }
+
+    tmpl := x509.Certificate{
+        SerialNumber: serial,
+        Subject: pkix.Name{CommonName: "las"},
+        NotBefore: time.Now().Add(-1 * time.Hour),
+        NotAfter: time.Now().Add(SelfSignedValidity),
+        KeyUsage: x509.KeyUsageDigitalSignature,
+        ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+        DNSNames: []string{"localhost"},
+        IPAddresses: []net.IP{net.ParseIP("127.0.0.1")},
+    }
+    hosts := []string{}
+    if u, err := url.Parse(config.PublicUrl); err == nil && u.Hostname() != "" {
+        hosts = append(hosts, u.Hostname())
+    }
+    if name, err := os.Hostname(); err == nil {
+        hosts = append(hosts, name)
+    }
+    for _, h := range hosts {
+        if h == "localhost" || h == "127.0.0.1" {
+            continue
+        }
+        if ip := net.ParseIP(h); ip != nil {
+            tmpl.IPAddresses = append(tmpl.IPAddresses, ip)
+        } else {
+            tmpl.DNSNames = append(tmpl.DNSNames, h)
+        }
+    }
+
+    der, err := x509.CreateCertificate(rand.Reader, &tmpl, &tmpl, &key.PublicKey, key)
+    if err != nil {
+        return err
+    }
+    keyDer, err := x509.MarshalECPrivateKey(key)
+    if err != nil {
+        return err
+    }
+
+    if err = ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600); err != nil {
+        return err
+    }
+    return ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644)
+}
+
+// requireClientCert wraps a job API handler so that, if a client CA is
+// configured, only clients with a verified certificate may use it.
+func requireClientCert(fn http.HandlerFunc) http.HandlerFunc {
+    return func(w http.ResponseWriter, r *http.Request) {
+        if config.TlsClientCa != "" && (r.TLS == nil || len(r.TLS.VerifiedChains) == 0) {
+            slog.Warn("Rejecting API request without a client certificate", "remote", r.RemoteAddr, "path", r.URL.Path)
+            http.Error(w, "Client certificate required", http.StatusForbidden)
+            return
+        }
+        fn(w, r)
+    }
+}
+
+// newServer returns a server for addr whose timeouts keep slow or idle
+// clients from holding connections open.  ReadTimeout leaves time for the
+// largest webhook.
+func newServer(addr string, handler http.Handler) *http.Server {
+    return &http.Server{
+        Addr: addr,
+        Handler: handler,
+        ReadHeaderTimeout: ReadHeaderTimeout,
+        ReadTimeout: ReadTimeout,
+        WriteTimeout: WriteTimeout,
+        IdleTimeout: IdleTimeout,
+    }
+}
+
+// redirectToHttps sends plain HTTP requests to the HTTPS listener.
+func redirectToHttps(w http.ResponseWriter, r *http.Request) {
+    target := strings.TrimSuffix(config.PublicUrl, "/")
+    if !strings.HasPrefix(target, "https://") {
+        host := r.Host
+        if h, _, err := net.SplitHostPort(r.Host); err == nil {
+            host = h
+        }
+        _, port, _ := net.SplitHostPort(config.Listen)
+        target = "https://" + net.JoinHostPort(host, port)
+    }
+
+    http.Redirect(w, r, target+r.URL.RequestURI(), http.StatusPermanentRedirect)
+}
+
+// shutdown stops the listener gracefully: no new webhooks are accepted, the
+// tenants' running jobs get until the shutdown timeout to finish before they
+// are interrupted, and jobs still queued are saved for the next start.
+func shutdown(servers ...*http.Server) {
+    var err error
+
+    ctx, cancel := context.WithTimeout(context.Background(), 10 * time.Second)
+    defer cancel()
+    for _, srv := range servers {
+        if err = srv.Shutdown(ctx); err != nil {
+            slog.Error("Failed to shut down HTTP server", "addr", srv.Addr, "err", err)
+        }
+    }
+
+    timeout := time.Duration(config.ShutdownTimeout) * time.Second
+
+    for _, t := range tenants {
+        t.Queue.Stop()
+    }
+    select {
+    case <-queuesDone():
+    case <-time.After(timeout):
+        slog.Warn("Running jobs did not finish in time", "timeout", timeout)
+        for _, t := range tenants {
+            t.Queue.Interrupt()
+        }
+        select {
+        case <-queuesDone():
+        case <-time.After(ShutdownGrace):
+            slog.Warn("Running jobs did not stop after being interrupted, cancelling them")
+            for _, t := range tenants {
+                t.Queue.Cancel()
+            }
+            <-queuesDone()
+        }
+    }
+
+    for _, t := range tenantList() {
+        pending := t.Queue.Pending()
+        if len(pending) == 0 {
+            continue
+        }
+        if err = SaveJobs(t.Config.QueueFile, pending); err != nil {
+            slog.Error("Failed to save queued jobs", "tenant", t.Name, "count", len(pending), "err", err)
+            continue
+        }
+        slog.Info("Saved queued jobs", "tenant", t.Name, "count", len(pending))
+    }
+}
+
+// queuesDone returns a channel that's closed once every tenant's queue has
+// stopped.
+func queuesDone() <-chan struct{} {
+    done := make(chan struct{})
+    go func() {
+        for _, t := range tenants {
+            <-t.Queue.Done()
+        }
+        close(done)
+    }()
+    return done
+}
+
+func main() {
+    var err error
+
+    args := os.Args[1:]
+    if len(args) >= 2 && args[0] == "config" && args[1] == "show" {
+        os.Exit(showConfig(args[2:]))
+    } else if len(args) >= 2 && args[0] == "secret" && args[1] == "encrypt" {
+        os.Exit(runEncrypt(args[2:]))
+    } else if len(args) >= 1 && args[0] == "check" {
+        os.Exit(runCheck(args[1:]))
+    }
+
+    if config, err = loadConfig("las", args); err == flag.ErrHelp {
+        os.Exit(0)
+    } else if err != nil {
+        fmt.Fprintf(os.Stderr, "%s\n", err)
+        os.Exit(2)
+    }
+    if err = resolveSecrets(&config); err != nil {
+        fmt.Fprintf(os.Stderr, "%s\n", err)
+        os.Exit(2)
+    }
+    if err = loadTemplates(); err != nil {
+        fmt.Fprintf(os.Stderr, "%s\n", err)
+        os.Exit(1)
+    }
+
+    lf, err = OpenRotatingLog(config.LogFile, config.LogMaxSize << 20, time.Duration(config.LogMaxAge) * time.Hour, config.LogKeep)
+    if err != nil {
+        fmt.Fprintf(os.Stderr, "Opening log file: %s\n", err)
+        os.Exit(1)
+    }
+    defer lf.Close()
+
+    slog.SetDefault(newLogger(lf, config.LogFormat))
+    slog.Info("Starting hooksrv")
+
+    // Each job's subprocess output goes to a file of its own.
+    if err = os.MkdirAll(config.JobLogDir, 0750); err != nil {
+        slog.Error("Creating job log directory", "dir", config.JobLogDir, "err", err)
+        fmt.Fprintf(os.Stderr, "Creating job log directory: %s\n", err)
+        lf.Close()
+        os.Exit(1)
+    }
+    pruneJobLogs(config.JobLogDir, JobHistory)
+
+    // Deployments for each tenant's firewall are serialized through a worker
+    // of its own, so tenants don't wait on each other.
+    jobs = NewJobStore(JobHistory)
+    tenants = make(map[string]*Tenant)
+    for name, c := range tenantConfigs(config) {
+        tenants[name] = NewTenant(name, c)
+    }
+    for _, t := range tenantList() {
+        // Pick up any jobs left queued by the last shutdown.
+        saved, err := LoadJobs(t, t.Config.QueueFile)
+        if err != nil {
+            slog.Error("Failed to load saved jobs", "tenant", t.Name, "err", err)
+        }
+        for _, job := range saved {
+            jobs.Add(job)
+            if err = t.Queue.Enqueue(job); err != nil {
+                job.Log().Error("Failed to requeue job", "err", err)
+                job.Finish(err)
+                continue
+            }
+            job.Log().Info("Requeued job")
+        }
+        go t.Queue.Run()
+
+        // Watch for the firewall to come up.
+        go t.Firewall.Run()
+    }
+
+    http.HandleFunc("/", handleReq)
+    http.HandleFunc("/hooks/", handleReq)
+    http.HandleFunc("/api/jobs", requireClientCert(handleJobs))
+    http.HandleFunc("/api/jobs/", requireClientCert(handleJob))
+    http.HandleFunc("/api/deploy", requireClientCert(handleDeploy))
+    http.HandleFunc("/metrics", requireClientCert(handleMetrics))
+    http.HandleFunc("/healthz", handleHealthz)
+    http.HandleFunc("/readyz", handleReadyz)
+
+    srv := newServer(config.Listen, nil)
+    servers := []*http.Server{srv}
+
+    if config.TlsCert != "" || config.TlsSelfSigned {
+        if err = configureTls(srv); err != nil {
+            fatal("Failed to configure TLS", err)
+        }
+        go func() {
+            slog.Info("Listening for HTTPS", "addr", srv.Addr)
+            if err := srv.ListenAndServeTLS(config.TlsCert, config.TlsKey); err != http.ErrServerClosed {
+                fatal("HTTPS listener failed", err)
+            }
+        }()
+
+        if config.RedirectListen != "" {
+            rsrv := newServer(config.RedirectListen, http.HandlerFunc(redirectToHttps))
+            servers = append(servers, rsrv)
+            go func() {
+                slog.Info("Redirecting HTTP to HTTPS", "addr", rsrv.Addr)
+                if err := rsrv.ListenAndServe(); err != http.ErrServerClosed {
+                    fatal("HTTP redirect listener failed", err)
+                }
+            }()
+        }
+    } else {
+        go func() {
+            slog.Info("Listening for HTTP", "addr", srv.Addr)
+            if err := srv.ListenAndServe(); err != http.ErrServerClosed {
+                fatal("HTTP listener failed", err)
+            }
+        }()
+    }
+
+    sigs := make(chan os.Signal, 1)
+    signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+    slog.Info("Shutting down", "signal", (<-sigs).String())
+    shutdown(servers...)
+    slog.Info("Shutdown complete")
+}
@@ -0,0 +1,1353 @@
+package main
+
+import (
+    "bytes"
+    "crypto/hmac"
+    "encoding/xml"
+    "crypto/sha256"
+    "encoding/hex"
+    "encoding/json"
+    "errors"
+    "flag"
+    "fmt"
+    "net/http"
+    "net/http/httptest"
+    "os"
+    "path/filepath"
+    "reflect"
+    "sort"
+    "strings"
+    "testing"
+    "time"
+)
+
+// checkErr fails the test unless err contains want, or is nil if want is
+// empty.
+func checkErr(t *testing.T, err error, want string) {
+    t.Helper()
+    if want == "" && err != nil {
+        t.Fatalf("Unexpected error: %s", err)
+    } else if want != "" && (err == nil || !strings.Contains(err.Error(), want)) {
+        t.Fatalf("Error is %v, not %q", err, want)
+    }
+}
+
+var update = flag.Bool("update", false, "rewrite the golden files in testdata")
+
+// checkGolden fails the test unless got matches the golden file of the given
+// name in testdata.  With -update the golden file is rewritten instead.
+func checkGolden(t *testing.T, name, got string) {
+    t.Helper()
+    path := filepath.Join("testdata", name)
+    if *update {
+        if err := os.MkdirAll("testdata", 0755); err != nil {
+            t.Fatal(err)
+        }
+        if err := os.WriteFile(path, []byte(got), 0644); err != nil {
+            t.Fatal(err)
+        }
+        return
+    }
+
+    want, err := os.ReadFile(path)
+    if err != nil {
+        t.Fatalf("%s (run go test -update to create it)", err)
+    }
+    if got != string(want) {
+        t.Fatalf("Output doesn't match %s:\n%s", path, got)
+    }
+}
+
+func TestVerifyHmac(t *testing.T) {
+    body := []byte(`{"ref":"refs/heads/master"}`)
+    mac := hmac.New(sha256.New, []byte("s3cret"))
+    mac.Write(body)
+    sig := hex.EncodeToString(mac.Sum(nil))
+
+    tests := []struct {
+        name string
+        sig string
+        body []byte
+        secret string
+        err string
+    }{
+        {"valid", sig, body, "s3cret", ""},
+        {"wrong secret", sig, body, "other", "Signature mismatch"},
+        {"changed body", sig, []byte(`{"ref":"refs/heads/evil"}`), "s3cret", "Signature mismatch"},
+        {"truncated", sig[:20], body, "s3cret", "Signature mismatch"},
+        {"empty", "", body, "s3cret", "Signature mismatch"},
+        {"not hex", "sha256=" + sig, body, "s3cret", "Failed to decode signature"},
+    }
+
+    for _, tc := range tests {
+        t.Run(tc.name, func(t *testing.T) {
+            checkErr(t, verifyHmac(tc.sig, tc.body, tc.secret), tc.err)
+        })
+    }
+}
+
+func TestGitHubVerify(t *testing.T) {
+    body := []byte(`{"ref":"refs/heads/master"}`)
+    mac := hmac.New(sha256.New, []byte("s3cret"))
+    mac.Write(body)
+    sig := hex.EncodeToString(mac.Sum(nil))
+
+    tests := []struct {
+        name string
+        header string
+        err string
+    }{
+        {"valid", "sha256=" + sig, ""},
+        {"missing", "", "No X-Hub-Signature-256 header"},
+        {"sha1", "sha1=" + sig, "Unsupported signature format"},
+        {"bare hex", sig, "Unsupported signature format"},
+        {"mismatch", "sha256=" + sig[:62] + "00", "Signature mismatch"},
+    }
+
+    for _, tc := range tests {
+        t.Run(tc.name, func(t *testing.T) {
+            r := httptest.NewRequest("POST", "/", nil)
+            if tc.header != "" {
+                r.Header.Set("X-Hub-Signature-256", tc.header)
+            }
+            checkErr(t, GitHub{}.Verify(r, body, "s3cret"), tc.err)
+        })
+    }
+}
+
+func TestHandlePush(t *testing.T) {
+    sha := strings.Repeat("ab", 20)
+    tests := []struct {
+        name string
+        ev Event
+        code int
+        state string
+        reason string
+    }{
+        {"queued", Event{Repo: "HookOrg/acct", Pusher: "acct", Message: "Add ssh", Sha: sha}, http.StatusAccepted, JobQueued, ""},
+        {"other repo", Event{Repo: "HookOrg/other", Pusher: "acct", Message: "Add ssh", Sha: sha}, http.StatusOK, JobSkipped, "Invalid repo name"},
+        {"other user", Event{Repo: "HookOrg/acct", Pusher: "mallory", Message: "Add ssh", Sha: sha}, http.StatusOK, JobSkipped, "Skipping other user commit"},
+        {"no message", Event{Repo: "HookOrg/acct", Pusher: "acct", Sha: sha}, http.StatusOK, JobSkipped, "No head commit message"},
+        {"bad sha", Event{Repo: "HookOrg/acct", Pusher: "acct", Message: "Add ssh", Sha: "HEAD"}, http.StatusOK, JobSkipped, "Invalid commit SHA"},
+    }
+
+    for i, tc := range tests {
+        t.Run(tc.name, func(t *testing.T) {
+            jobs = NewJobStore(JobHistory)
+            tn := &Tenant{
+                Name: "acct",
+                Config: HookConfig{GitHubAccount: "acct"},
+                Queue: NewQueue(1),
+                Ledger: &Ledger{path: filepath.Join(t.TempDir(), "ledger.json")},
+            }
+            tc.ev.Ref = "refs/heads/master"
+            tc.ev.DefaultBranch = "master"
+            tc.ev.Delivery = fmt.Sprintf("delivery-%d", i)
+
+            w := httptest.NewRecorder()
+            handlePush(w, tn, &tc.ev)
+            if w.Code != tc.code {
+                t.Fatalf("Response is %d, not %d: %s", w.Code, tc.code, w.Body)
+            }
+            var resp map[string]string
+            if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+                t.Fatalf("Response %q: %s", w.Body, err)
+            }
+            job := jobs.Get(resp["id"])
+            if job == nil {
+                t.Fatalf("Job %q wasn't recorded", resp["id"])
+            }
+            if s := job.Status(false); s.State != tc.state || !strings.Contains(s.Reason, tc.reason) {
+                t.Fatalf("Job is %s (%q), not %s (%q)", s.State, s.Reason, tc.state, tc.reason)
+            }
+        })
+    }
+}
+
+func TestJobStoreEvictsOldest(t *testing.T) {
+    tests := []struct {
+        max int
+        add []string
+        want []string
+    }{
+        {3, []string{"a", "b"}, []string{"b", "a"}},
+        {3, []string{"a", "b", "c", "d"}, []string{"d", "c", "b"}},
+        {1, []string{"a", "b", "c"}, []string{"c"}},
+    }
+
+    for _, tc := range tests {
+        s := NewJobStore(tc.max)
+        for _, id := range tc.add {
+            s.Add(&Job{JobStatus: JobStatus{Id: id, State: JobSucceeded}})
+        }
+
+        ids := make([]string, 0)
+        for _, job := range s.List() {
+            ids = append(ids, job.Id)
+        }
+        if !reflect.DeepEqual(ids, tc.want) {
+            t.Fatalf("Kept %q of %q, not %q", ids, tc.add, tc.want)
+        }
+        if s.Get(tc.add[0]) != nil && len(tc.add) > tc.max {
+            t.Fatalf("Job %q is still there", tc.add[0])
+        }
+    }
+}
+
+func TestJobStoreKeepsUnfinishedJobs(t *testing.T) {
+    s := NewJobStore(3)
+    s.Add(&Job{JobStatus: JobStatus{Id: "running", State: JobRunning}})
+    s.Add(&Job{JobStatus: JobStatus{Id: "queued", State: JobQueued}})
+    for _, id := range []string{"a", "b", "c"} {
+        s.Add(&Job{JobStatus: JobStatus{Id: id, State: JobSkipped}})
+    }
+
+    ids := make([]string, 0)
+    for _, job := range s.List() {
+        ids = append(ids, job.Id)
+    }
+    if want := []string{"c", "queued", "running"}; !reflect.DeepEqual(ids, want) {
+        t.Fatalf("Kept %q, not %q", ids, want)
+    }
+}
+
+func TestSkipReason(t *testing.T) {
+    sha := strings.Repeat("ab", 20)
+    tests := []struct {
+        name string
+        refs []string
+        ref string
+        sha string
+        deleted bool
+        want string
+    }{
+        {"default branch", nil, "refs/heads/master", sha, false, ""},
+        {"other branch", nil, "refs/heads/dev", sha, false, "refs/heads/dev does not match any allowed ref"},
+        {"tag", nil, "refs/tags/v1", sha, false, "does not match any allowed ref"},
+        {"deleted", nil, "refs/heads/master", sha, true, "refs/heads/master was deleted"},
+        {"zero sha", nil, "refs/heads/master", ZeroSha, false, "was deleted"},
+        {"listed", []string{"refs/heads/dev"}, "refs/heads/dev", sha, false, ""},
+        {"listed replaces default", []string{"refs/heads/dev"}, "refs/heads/master", sha, false, "does not match"},
+        {"pattern", []string{"refs/heads/release/*"}, "refs/heads/release/1.0", sha, false, ""},
+        {"pattern is one level", []string{"refs/heads/release/*"}, "refs/heads/release/1.0/fix", sha, false, "does not match"},
+        {"tag pattern", []string{"refs/heads/master", "refs/tags/v*"}, "refs/tags/v2", sha, false, ""},
+    }
+
+    for _, tc := range tests {
+        t.Run(tc.name, func(t *testing.T) {
+            ev := Event{Ref: tc.ref, Sha: tc.sha, Deleted: tc.deleted, DefaultBranch: "master"}
+            got := ev.SkipReason(&HookConfig{Refs: tc.refs})
+            if (tc.want == "" && got != "") || !strings.Contains(got, tc.want) {
+                t.Fatalf("Skip reason is %q, not %q", got, tc.want)
+            }
+        })
+    }
+}
+
+func TestDiffServices(t *testing.T) {
+    ssh := DemoService{Name: "ssh", Ports: []PortSpec{"22"}}
+    web := DemoService{Name: "web", Ports: []PortSpec{"80", "443"}}
+    dns := DemoService{Name: "dns", Protocol: "udp", Ports: []PortSpec{"53"}}
+    sshMoved := DemoService{Name: "ssh", Ports: []PortSpec{"2222"}}
+    sshScoped := DemoService{Name: "ssh", Ports: []PortSpec{"22"}, SourceAddresses: []string{"10.0.0.0/8"}}
+
+    tests := []struct {
+        name string
+        before []DemoService
+        after []DemoService
+        want []string
+    }{
+        {"none", []DemoService{ssh, web}, []DemoService{web, ssh}, []string{}},
+        {"first plan", nil, []DemoService{ssh}, []string{"added ssh"}},
+        {"added", []DemoService{ssh}, []DemoService{ssh, dns}, []string{"added dns"}},
+        {"removed", []DemoService{ssh, web}, []DemoService{ssh}, []string{"removed web"}},
+        {"ports", []DemoService{ssh}, []DemoService{sshMoved}, []string{"changed ssh"}},
+        {"rule only", []DemoService{ssh}, []DemoService{sshScoped}, []string{"changed ssh"}},
+        {"all", []DemoService{ssh, web}, []DemoService{sshMoved, dns}, []string{"changed ssh", "added dns", "removed web"}},
+    }
+
+    for _, tc := range tests {
+        t.Run(tc.name, func(t *testing.T) {
+            got := make([]string, 0)
+            for _, c := range diffServices(tc.before, tc.after) {
+                got = append(got, c.Action + " " + c.Name)
+            }
+            if !reflect.DeepEqual(got, tc.want) {
+                t.Fatalf("Changes are %q, not %q", got, tc.want)
+            }
+        })
+    }
+}
+
+func TestPlanComment(t *testing.T) {
+    base := &DemoConfig{
+        Method: "terraform",
+        Services: []DemoService{
+            {Name: "ssh", Ports: []PortSpec{"22"}},
+            {Name: "web", Ports: []PortSpec{"80", "443"}},
+        },
+    }
+    demo := &DemoConfig{
+        Method: "terraform",
+        Services: []DemoService{
+            {Name: "ssh", Ports: []PortSpec{"22"}, SourceAddresses: []string{"10.0.0.0/8"}},
+            {Name: "dns", Protocol: "both", Ports: []PortSpec{"53"}},
+        },
+    }
+
+    tests := []struct {
+        name string
+        base *DemoConfig
+        demo *DemoConfig
+        output string
+        err error
+    }{
+        {"plan_changes.md", base, demo, "Plan: 4 to add, 1 to change, 2 to destroy.\n", nil},
+        {"plan_first.md", nil, base, "", nil},
+        {"plan_unchanged.md", base, base, "No changes.\n", nil},
+        {"plan_failed.md", base, nil, "Error: Invalid reference\n", errors.New("exit status 1")},
+    }
+
+    for _, tc := range tests {
+        t.Run(tc.name, func(t *testing.T) {
+            job := &Job{JobStatus: JobStatus{Sha: strings.Repeat("ab", 20), Method: "terraform", Stage: "plan"}}
+            checkGolden(t, tc.name, planComment(job, tc.base, tc.demo, tc.output, tc.err))
+        })
+    }
+}
+
+func TestParseGitHubEvent(t *testing.T) {
+    sha := strings.Repeat("ab", 20)
+    base := strings.Repeat("cd", 20)
+    push := fmt.Sprintf(`{"ref":"refs/heads/master","after":"%s","repository":{"full_name":"HookOrg/acct","default_branch":"master"},"pusher":{"name":"acct"},"head_commit":{"message":"Add ssh"}}`, sha)
+    pr := func(action string) string {
+        return fmt.Sprintf(`{"action":"%s","number":7,"pull_request":{"head":{"ref":"ssh","sha":"%s"},"base":{"ref":"master","sha":"%s"}},"repository":{"full_name":"HookOrg/acct"},"sender":{"login":"bob"}}`, action, sha, base)
+    }
+    prEvent := &Event{Kind: EventPullRequest, Delivery: "d1", Repo: "HookOrg/acct", Ref: "ssh", Sha: sha, Pusher: "bob", PullRequest: 7, FetchRef: "refs/pull/7/head", Base: base}
+
+    tests := []struct {
+        name string
+        event string
+        body string
+        sync string
+        want *Event
+        err string
+    }{
+        {"push", "push", push, "synchronize", &Event{Kind: EventPush, Delivery: "d1", Repo: "HookOrg/acct", Ref: "refs/heads/master", Sha: sha, DefaultBranch: "master", Pusher: "acct", Message: "Add ssh"}, ""},
+        {"gitea pusher", "push", `{"ref":"refs/heads/master","after":"` + sha + `","pusher":{"login":"acct"}}`, "synchronized", &Event{Kind: EventPush, Delivery: "d1", Ref: "refs/heads/master", Sha: sha, Pusher: "acct"}, ""},
+        {"deleted", "push", `{"ref":"refs/heads/old","after":"` + ZeroSha + `","deleted":true}`, "synchronize", &Event{Kind: EventPush, Delivery: "d1", Ref: "refs/heads/old", Sha: ZeroSha, Deleted: true}, ""},
+        {"ping", "ping", `{"zen":"Keep it simple.","hook":{"id":1}}`, "synchronize", &Event{Kind: EventPing, Delivery: "d1"}, ""},
+        {"opened", "pull_request", pr("opened"), "synchronize", prEvent, ""},
+        {"github sync", "pull_request", pr("synchronize"), "synchronize", prEvent, ""},
+        {"gitea sync", "pull_request", pr("synchronized"), "synchronized", prEvent, ""},
+        {"closed", "pull_request", pr("closed"), "synchronize", nil, ""},
+        {"create", "create", `{"ref":"v1","ref_type":"tag"}`, "synchronize", nil, ""},
+        {"unsupported", "star", `{}`, "synchronize", nil, ""},
+        {"no header", "", push, "synchronize", nil, "No event header present"},
+        {"bad push", "push", `{"ref":1}`, "synchronize", nil, "Invalid push payload"},
+        {"bad pull request", "pull_request", `[]`, "synchronize", nil, "Invalid pull_request payload"},
+    }
+
+    for _, tc := range tests {
+        t.Run(tc.name, func(t *testing.T) {
+            ev, err := parseGitHubEvent(tc.event, "d1", []byte(tc.body), tc.sync)
+            checkErr(t, err, tc.err)
+            if !reflect.DeepEqual(ev, tc.want) {
+                t.Fatalf("Event is %+v, not %+v", ev, tc.want)
+            }
+        })
+    }
+}
+
+func TestGitLabParse(t *testing.T) {
+    sha := strings.Repeat("ab", 20)
+    tag := strings.Repeat("ef", 20)
+    project := `"project":{"path_with_namespace":"HookOrg/acct","default_branch":"master"}`
+    push := func(ref, after, checkout, commits string) string {
+        return fmt.Sprintf(`{"ref":"%s","after":"%s","checkout_sha":%s,"user_username":"acct",%s,"commits":[%s]}`, ref, after, checkout, project, commits)
+    }
+    pushEvent := func(ref, sha, message string) *Event {
+        return &Event{Kind: EventPush, Delivery: "d1", Repo: "HookOrg/acct", Ref: ref, Sha: sha, DefaultBranch: "master", Pusher: "acct", Message: message}
+    }
+    mr := func(action, oldrev string) string {
+        return fmt.Sprintf(`{"user":{"username":"bob"},%s,"object_attributes":{"iid":7,"action":"%s","source_branch":"ssh","target_branch":"master","oldrev":"%s","last_commit":{"id":"%s"}}}`, project, action, oldrev, sha)
+    }
+    mrEvent := &Event{Kind: EventPullRequest, Delivery: "d1", Repo: "HookOrg/acct", Ref: "ssh", Sha: sha, Pusher: "bob", PullRequest: 7, FetchRef: "refs/merge-requests/7/head", Base: "origin/master"}
+
+    tests := []struct {
+        name string
+        event string
+        body string
+        want *Event
+        err string
+    }{
+        {"push", "Push Hook", push("refs/heads/master", sha, `"`+sha+`"`, `{"id":"`+tag+`","message":"Earlier"},{"id":"`+sha+`","message":"Add ssh"}`), pushEvent("refs/heads/master", sha, "Add ssh"), ""},
+        {"existing commit", "Push Hook", push("refs/heads/master", sha, `"`+sha+`"`, ""), pushEvent("refs/heads/master", sha, DefaultMessage), ""},
+        {"lightweight tag", "Tag Push Hook", push("refs/tags/v1", sha, `"`+sha+`"`, ""), pushEvent("refs/tags/v1", sha, DefaultMessage), ""},
+        {"annotated tag", "Tag Push Hook", push("refs/tags/v1", tag, `"`+sha+`"`, ""), pushEvent("refs/tags/v1", sha, DefaultMessage), ""},
+        {"deleted", "Push Hook", push("refs/heads/old", ZeroSha, "null", ""), &Event{Kind: EventPush, Delivery: "d1", Repo: "HookOrg/acct", Ref: "refs/heads/old", Sha: ZeroSha, Deleted: true, DefaultBranch: "master", Pusher: "acct", Message: DefaultMessage}, ""},
+        {"opened", "Merge Request Hook", mr("open", ""), mrEvent, ""},
+        {"new commits", "Merge Request Hook", mr("update", tag), mrEvent, ""},
+        {"edited", "Merge Request Hook", mr("update", ""), nil, ""},
+        {"merged", "Merge Request Hook", mr("merge", ""), nil, ""},
+        {"unsupported", "Note Hook", `{}`, nil, ""},
+        {"no header", "", `{}`, nil, "No X-Gitlab-Event header"},
+        {"bad push", "Push Hook", `{"commits":{}}`, nil, "Invalid push payload"},
+        {"bad merge request", "Merge Request Hook", `[]`, nil, "Invalid merge request payload"},
+    }
+
+    for _, tc := range tests {
+        t.Run(tc.name, func(t *testing.T) {
+            r := httptest.NewRequest("POST", "/", nil)
+            if tc.event != "" {
+                r.Header.Set("X-Gitlab-Event", tc.event)
+            }
+            r.Header.Set("X-Gitlab-Event-UUID", "d1")
+            ev, err := GitLab{}.Parse(r, []byte(tc.body))
+            checkErr(t, err, tc.err)
+            if !reflect.DeepEqual(ev, tc.want) {
+                t.Fatalf("Event is %+v, not %+v", ev, tc.want)
+            }
+        })
+    }
+}
+
+func TestProviderVerify(t *testing.T) {
+    body := []byte(`{"ref":"refs/heads/master"}`)
+    mac := hmac.New(sha256.New, []byte("s3cret"))
+    mac.Write(body)
+    sig := hex.EncodeToString(mac.Sum(nil))
+
+    tests := []struct {
+        name string
+        provider Provider
+        header string
+        value string
+        err string
+    }{
+        {"gitea", Gitea{}, "X-Gitea-Signature", sig, ""},
+        {"gitea prefixed", Gitea{}, "X-Gitea-Signature", "sha256=" + sig, "Failed to decode signature"},
+        {"gitea missing", Gitea{}, "", "", "No X-Gitea-Signature header"},
+        {"gitea github header", Gitea{}, "X-Hub-Signature-256", "sha256=" + sig, "No X-Gitea-Signature header"},
+        {"gitlab", GitLab{}, "X-Gitlab-Token", "s3cret", ""},
+        {"gitlab wrong token", GitLab{}, "X-Gitlab-Token", "s3cre", "Token mismatch"},
+        {"gitlab missing", GitLab{}, "", "", "No X-Gitlab-Token header"},
+    }
+
+    for _, tc := range tests {
+        t.Run(tc.name, func(t *testing.T) {
+            r := httptest.NewRequest("POST", "/", nil)
+            if tc.header != "" {
+                r.Header.Set(tc.header, tc.value)
+            }
+            checkErr(t, tc.provider.Verify(r, body, "s3cret"), tc.err)
+        })
+    }
+}
+
+func TestLedgerIsDeployed(t *testing.T) {
+    l, err := LoadLedger(filepath.Join(t.TempDir(), "ledger.json"))
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    steps := []struct {
+        deploy string
+        sha string
+        want bool
+    }{
+        {"", "a", false},
+        {"a", "a", true},
+        {"b", "a", false},
+        {"", "b", true},
+        {"a", "a", true},
+        {"", "b", false},
+    }
+    for i, s := range steps {
+        if s.deploy != "" {
+            l.AddDeployed(s.deploy)
+        }
+        if got := l.IsDeployed(s.sha); got != s.want {
+            t.Fatalf("Step %d: IsDeployed(%q) is %t", i, s.sha, got)
+        }
+    }
+}
+
+func TestLedgerSaves(t *testing.T) {
+    path := filepath.Join(t.TempDir(), "ledger.json")
+    l, err := LoadLedger(path)
+    checkErr(t, err, "")
+    if l.HasDelivery("d1") {
+        t.Fatal("New ledger has a delivery")
+    }
+
+    l.AddDelivery("d1")
+    l.AddDelivery("")
+    l.AddDeployed("a")
+    l.AddDeployed("a")
+
+    l, err = LoadLedger(path)
+    checkErr(t, err, "")
+    if !l.HasDelivery("d1") || l.HasDelivery("") || !l.IsDeployed("a") {
+        t.Fatalf("Saved ledger is %+v", l)
+    }
+    if want := []string{"a"}; !reflect.DeepEqual(l.Deployed, want) {
+        t.Fatalf("Deployed is %q, not %q", l.Deployed, want)
+    }
+
+    if err = os.WriteFile(path, []byte("{"), 0600); err != nil {
+        t.Fatal(err)
+    }
+    _, err = LoadLedger(path)
+    checkErr(t, err, "Failed to parse ledger")
+}
+
+func TestMetricsWrite(t *testing.T) {
+    m := NewMetrics()
+    m.Received("github")
+    m.Received("github")
+    m.Received("gitlab")
+    m.Rejected("signature")
+    m.Deployed(JobSucceeded)
+    m.Deployed(JobFailed)
+    m.DeploySucceeded("fw\"1", time.Unix(1700000000, 500000000))
+    m.ObserveStage("apply", "terraform", 20 * time.Second)
+    m.ObserveStage("apply", "terraform", 400 * time.Second)
+    m.ObserveStage("apply", "ansible", 90 * time.Second)
+    m.ObserveStage("checkout", "", 500 * time.Millisecond)
+
+    var b bytes.Buffer
+    m.Write(&b, map[string]int{"bob": 2, "alice": 0})
+    checkGolden(t, "metrics.txt", b.String())
+}
+
+func TestRotatingLog(t *testing.T) {
+    tests := []struct {
+        name string
+        maxSize int
+        maxAge time.Duration
+        rotated int
+    }{
+        {"by size", 10, 0, 2},
+        {"by age", 0, time.Nanosecond, 2},
+        {"size off", -1, 0, 0},
+        {"both off", -1 << 20, -time.Hour, 0},
+    }
+
+    for _, tc := range tests {
+        t.Run(tc.name, func(t *testing.T) {
+            path := filepath.Join(t.TempDir(), "las.log")
+            l, err := OpenRotatingLog(path, tc.maxSize, tc.maxAge, 5)
+            if err != nil {
+                t.Fatal(err)
+            }
+            defer l.Close()
+
+            for i := 0; i < 3; i++ {
+                // Rotated logs are named by the millisecond.
+                time.Sleep(2 * time.Millisecond)
+                l.Write([]byte("12345678"))
+            }
+            if old, _ := filepath.Glob(path + ".*"); len(old) != tc.rotated {
+                t.Fatalf("Rotated %d times, not %d", len(old), tc.rotated)
+            }
+        })
+    }
+}
+
+func TestLogRotationDefaults(t *testing.T) {
+    tests := []struct {
+        given int
+        want int
+    }{
+        {0, DefaultLogMaxSize},
+        {5, 5},
+        {-1, -1},
+    }
+
+    for _, tc := range tests {
+        c := HookConfig{LogMaxSize: tc.given, LogMaxAge: tc.given}
+        applyDefaults(&c)
+        if c.LogMaxSize != tc.want || (tc.given != 0 && c.LogMaxAge != tc.want) {
+            t.Fatalf("log_max_size_mb %d became %d and log_max_age_hours %d", tc.given, c.LogMaxSize, c.LogMaxAge)
+        }
+    }
+}
+
+func TestReadConfig(t *testing.T) {
+    dir := t.TempDir()
+    file := filepath.Join(dir, "config.json")
+    if err := os.WriteFile(file, []byte(`{"listen": ":1", "base_dir": "/file", "shutdown_timeout": 10}`), 0600); err != nil {
+        t.Fatal(err)
+    }
+
+    tests := []struct {
+        name string
+        env map[string]string
+        args []string
+        listen string
+        baseDir string
+        ledger string
+        err string
+    }{
+        {"file", nil, []string{"-config", file}, ":1", "/file", "/file/las-ledger.json", ""},
+        {"env over file", map[string]string{"LAS_LISTEN": ":2"}, []string{"-config", file}, ":2", "/file", "/file/las-ledger.json", ""},
+        {"flag over env", map[string]string{"LAS_LISTEN": ":2"}, []string{"-config", file, "-listen", ":3"}, ":3", "/file", "/file/las-ledger.json", ""},
+        {"defaults from base_dir", map[string]string{"LAS_BASE_DIR": "/env"}, []string{"-config", file}, ":1", "/env", "/env/las-ledger.json", ""},
+        {"explicit ledger", nil, []string{"-config", file, "-ledger-file", "/l.json"}, ":1", "/file", "/l.json", ""},
+        {"config from env", map[string]string{"LAS_CONFIG": file}, nil, ":1", "/file", "/file/las-ledger.json", ""},
+        {"missing config", nil, []string{"-config", filepath.Join(dir, "missing.json")}, "", "", "", "no such file"},
+        {"bad number", map[string]string{"LAS_SHUTDOWN_TIMEOUT": "soon"}, []string{"-config", file}, "", "", "", "LAS_SHUTDOWN_TIMEOUT: Invalid shutdown_timeout"},
+        {"bad flag number", nil, []string{"-config", file, "-shutdown-timeout", "soon"}, "", "", "", "-shutdown-timeout: Invalid shutdown_timeout"},
+        {"extra arguments", nil, []string{"-config", file, "extra"}, "", "", "", "Unexpected arguments: extra"},
+    }
+
+    for _, tc := range tests {
+        t.Run(tc.name, func(t *testing.T) {
+            for k, v := range tc.env {
+                t.Setenv(k, v)
+            }
+
+            c, err := readConfig("las", tc.args)
+            checkErr(t, err, tc.err)
+            if tc.err != "" {
+                return
+            }
+            if c.Listen != tc.listen || c.BaseDir != tc.baseDir || c.LedgerFile != tc.ledger {
+                t.Fatalf("Got listen %q, base_dir %q and ledger_file %q", c.Listen, c.BaseDir, c.LedgerFile)
+            } else if c.ShutdownTimeout != 10 {
+                t.Fatalf("Got shutdown_timeout %d, not 10", c.ShutdownTimeout)
+            }
+        })
+    }
+}
+
+func TestCheckDemo(t *testing.T) {
+    // settings.json always has an exec; "las check" renders both.
+    dc := checkDemo
+    dc.Method = "terraform"
+    if err := dc.IsValid(); err != nil {
+        t.Fatalf("checkDemo isn't valid: %s", err)
+    }
+    if _, err := terraformConfig(checkDemo); err != nil {
+        t.Fatalf("Rendering the plan: %s", err)
+    }
+    if _, err := ansibleConfig(checkDemo); err != nil {
+        t.Fatalf("Rendering the playbook: %s", err)
+    }
+}
+
+func TestLoadTemplates(t *testing.T) {
+    saved := config
+    defer func() { config = saved }()
+    config.DemoDir = t.TempDir()
+
+    // A missing template is an error rather than a panic.
+    checkErr(t, loadTemplates(), "anchor/deploy.yml")
+
+    files := map[string]string{
+        "anchor/deploy.yml": "- hosts: all\n",
+        "tricky/plan.tf": "provider \"panos\" {}\n",
+    }
+    for name, body := range files {
+        path := filepath.Join(config.DemoDir, name)
+        if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+            t.Fatal(err)
+        }
+        if err := os.WriteFile(path, []byte(body), 0644); err != nil {
+            t.Fatal(err)
+        }
+    }
+    checkErr(t, loadTemplates(), "")
+    if string(ansibleBegin) != files["anchor/deploy.yml"] || string(terraformBegin) != files["tricky/plan.tf"] {
+        t.Fatalf("Templates are %q and %q", ansibleBegin, terraformBegin)
+    }
+}
+
+func TestBinaryVersion(t *testing.T) {
+    if _, err := binaryVersion("las-no-such-binary"); err == nil {
+        t.Fatal("Found a binary that doesn't exist")
+    }
+    p, err := binaryVersion("sh")
+    checkErr(t, err, "")
+    if !filepath.IsAbs(p) {
+        t.Fatalf("Path of sh is %q", p)
+    }
+    _, err = binaryVersion("sh", "-c", "exit 3")
+    checkErr(t, err, "-c exit 3 failed")
+}
+
+func TestFindTenant(t *testing.T) {
+    tenant := func(name, provider, secret string) *Tenant {
+        return &Tenant{Name: name, Config: HookConfig{GitHubAccount: name, Provider: provider, WebhookSecret: secret}}
+    }
+    candidates := []*Tenant{
+        tenant("alice", "github", "a"),
+        tenant("bob", "github", "shared"),
+        tenant("carol", "github", "shared"),
+        tenant("dave", "gitlab", "d"),
+    }
+    push := func(repo string) []byte {
+        return []byte(fmt.Sprintf(`{"ref":"refs/heads/master","after":"%s","repository":{"full_name":"%s"}}`, strings.Repeat("ab", 20), repo))
+    }
+
+    tests := []struct {
+        name string
+        secret string
+        gitlab bool
+        body []byte
+        tenant string
+        err string
+    }{
+        {"own secret", "a", false, push("HookOrg/alice"), "alice", ""},
+        {"shared secret", "shared", false, push("HookOrg/carol"), "carol", ""},
+        {"shared secret other repo", "shared", false, push("HookOrg/erin"), "bob", ""},
+        {"unknown secret", "x", false, push("HookOrg/alice"), "", ""},
+        {"gitlab", "d", true, []byte(`{"project":{"path_with_namespace":"HookOrg/dave"}}`), "dave", ""},
+        {"gitlab unknown token", "a", true, []byte(`{}`), "", ""},
+        {"bad payload", "a", false, []byte(`{"ref":1}`), "alice", "Invalid push payload"},
+    }
+
+    for _, tc := range tests {
+        t.Run(tc.name, func(t *testing.T) {
+            r := httptest.NewRequest("POST", "/", nil)
+            if tc.gitlab {
+                r.Header.Set("X-Gitlab-Event", "Push Hook")
+                r.Header.Set("X-Gitlab-Token", tc.secret)
+            } else {
+                mac := hmac.New(sha256.New, []byte(tc.secret))
+                mac.Write(tc.body)
+                r.Header.Set("X-GitHub-Event", "push")
+                r.Header.Set("X-Hub-Signature-256", "sha256=" + hex.EncodeToString(mac.Sum(nil)))
+            }
+
+            // Without a tenant, the error is only of interest for the log.
+            tn, ev, err := findTenant(r, tc.body, candidates)
+            if tn != nil {
+                checkErr(t, err, tc.err)
+            } else if err == nil {
+                t.Fatal("No error without a tenant")
+            }
+            name := ""
+            if tn != nil {
+                name = tn.Name
+            }
+            if name != tc.tenant {
+                t.Fatalf("Tenant is %q, not %q", name, tc.tenant)
+            }
+            if ev != nil && ev.Provider != tn.Config.Provider {
+                t.Fatalf("Event provider is %q, not %q", ev.Provider, tn.Config.Provider)
+            }
+        })
+    }
+}
+
+func TestApiTenants(t *testing.T) {
+    savedConfig, savedTenants, savedJobs := config, tenants, jobs
+    defer func() { config, tenants, jobs = savedConfig, savedTenants, savedJobs }()
+    config = HookConfig{ApiToken: "top"}
+    tenants = map[string]*Tenant{
+        "alice": {Name: "alice", Config: HookConfig{ApiToken: "alice-token"}},
+        "bob": {Name: "bob"},
+    }
+    jobs = NewJobStore(JobHistory)
+    jobs.Add(&Job{JobStatus: JobStatus{Id: "a1", Tenant: "alice", State: JobSucceeded}})
+    jobs.Add(&Job{JobStatus: JobStatus{Id: "b1", Tenant: "bob", State: JobSucceeded}})
+
+    tests := []struct {
+        name string
+        auth string
+        tenants []string
+        jobs []string
+    }{
+        {"top level", "Bearer top", []string{"alice", "bob"}, []string{"b1", "a1"}},
+        {"tenant", "Bearer alice-token", []string{"alice"}, []string{"a1"}},
+        {"wrong token", "Bearer bob-token", []string{}, nil},
+        {"empty token", "Bearer ", []string{}, nil},
+        {"no header", "", []string{}, nil},
+    }
+
+    for _, tc := range tests {
+        t.Run(tc.name, func(t *testing.T) {
+            r := httptest.NewRequest("GET", "/api/jobs", nil)
+            if tc.auth != "" {
+                r.Header.Set("Authorization", tc.auth)
+            }
+            got := make([]string, 0)
+            for name := range apiTenants(r) {
+                got = append(got, name)
+            }
+            sort.Strings(got)
+            if !reflect.DeepEqual(got, tc.tenants) {
+                t.Fatalf("Tenants are %q, not %q", got, tc.tenants)
+            }
+
+            w := httptest.NewRecorder()
+            handleJobs(w, r)
+            if tc.jobs == nil {
+                if w.Code != http.StatusUnauthorized {
+                    t.Fatalf("Response is %d, not %d", w.Code, http.StatusUnauthorized)
+                }
+                return
+            }
+            var list []JobStatus
+            if err := json.Unmarshal(w.Body.Bytes(), &list); err != nil {
+                t.Fatalf("Response %q: %s", w.Body, err)
+            }
+            ids := make([]string, 0)
+            for _, s := range list {
+                ids = append(ids, s.Id)
+            }
+            if !reflect.DeepEqual(ids, tc.jobs) {
+                t.Fatalf("Jobs are %q, not %q", ids, tc.jobs)
+            }
+
+            // Other tenants' jobs are as good as missing.
+            for _, id := range []string{"a1", "b1"} {
+                w := httptest.NewRecorder()
+                r := httptest.NewRequest("GET", "/api/jobs/" + id, nil)
+                r.Header.Set("Authorization", tc.auth)
+                handleJob(w, r)
+                if want := contains(tc.jobs, id); (w.Code == http.StatusOK) != want {
+                    t.Fatalf("Job %s response is %d", id, w.Code)
+                }
+            }
+        })
+    }
+}
+
+func TestResolveSecret(t *testing.T) {
+    dir := t.TempDir()
+    keyFile := filepath.Join(dir, "secret.key")
+    key, err := createSecretKey(keyFile)
+    if err != nil {
+        t.Fatal(err)
+    }
+    enc, err := encryptSecret(key, "from-enc")
+    if err != nil {
+        t.Fatal(err)
+    }
+    files := map[string]string{"pw": "from-file\n", "crlf": "from-crlf\r\n", "empty": "\n"}
+    for name, body := range files {
+        if err = os.WriteFile(filepath.Join(dir, name), []byte(body), 0600); err != nil {
+            t.Fatal(err)
+        }
+    }
+    t.Setenv("LAS_TEST_SECRET", "from-env")
+    t.Setenv("LAS_TEST_EMPTY", "")
+
+    tests := []struct {
+        ref string
+        want string
+        err string
+    }{
+        {"plain", "plain", ""},
+        {"with:colon", "with:colon", ""},
+        {"file:" + filepath.Join(dir, "pw"), "from-file", ""},
+        {"file:" + filepath.Join(dir, "crlf"), "from-crlf", ""},
+        {"file:" + filepath.Join(dir, "empty"), "", "is empty"},
+        {"file:" + filepath.Join(dir, "missing"), "", "no such file"},
+        {"env:LAS_TEST_SECRET", "from-env", ""},
+        {"env:LAS_TEST_EMPTY", "", "is empty"},
+        {"env:LAS_TEST_UNSET", "", "$LAS_TEST_UNSET is not set"},
+        {"exec:echo from-exec", "from-exec", ""},
+        {"exec:echo oops >&2; exit 1", "", "Secret helper failed: exit status 1: oops"},
+        {enc, "from-enc", ""},
+        {"enc:bm90IGVuY3J5cHRlZA==", "", "encrypted with a different key"},
+        {"enc:c2hvcnQ=", "", "Invalid encrypted secret"},
+    }
+
+    for _, tc := range tests {
+        t.Run(tc.ref, func(t *testing.T) {
+            got, err := resolveSecret(tc.ref, keyFile)
+            checkErr(t, err, tc.err)
+            if got != tc.want {
+                t.Fatalf("Secret is %q, not %q", got, tc.want)
+            }
+        })
+    }
+}
+
+func TestSecretKey(t *testing.T) {
+    path := filepath.Join(t.TempDir(), "secret.key")
+    key, err := createSecretKey(path)
+    checkErr(t, err, "")
+    _, err = createSecretKey(path)
+    checkErr(t, err, "file exists")
+
+    read, err := readSecretKey(path)
+    checkErr(t, err, "")
+    if !bytes.Equal(read, key) {
+        t.Fatal("Read a different key")
+    }
+
+    // Each encryption is different, but they all decrypt.
+    a, err := encryptSecret(key, "s3cret")
+    checkErr(t, err, "")
+    b, err := encryptSecret(key, "s3cret")
+    checkErr(t, err, "")
+    if a == b || !strings.HasPrefix(a, "enc:") {
+        t.Fatalf("Encrypted secrets are %q and %q", a, b)
+    }
+    for _, enc := range []string{a, b} {
+        got, err := decryptSecret(key, strings.TrimPrefix(enc, "enc:"))
+        checkErr(t, err, "")
+        if got != "s3cret" {
+            t.Fatalf("Decrypted %q", got)
+        }
+    }
+
+    other := make([]byte, 32)
+    _, err = decryptSecret(other, strings.TrimPrefix(a, "enc:"))
+    checkErr(t, err, "encrypted with a different key")
+    _, err = decryptSecret(key, "not base64!")
+    checkErr(t, err, "Invalid encrypted secret")
+
+    if err = os.Chmod(path, 0644); err != nil {
+        t.Fatal(err)
+    }
+    _, err = readSecretKey(path)
+    checkErr(t, err, "must not be accessible by others")
+    if err = os.Remove(path); err != nil {
+        t.Fatal(err)
+    }
+    if err = os.WriteFile(path, []byte("c2hvcnQ=\n"), 0600); err != nil {
+        t.Fatal(err)
+    }
+    _, err = readSecretKey(path)
+    checkErr(t, err, "is not a secret key")
+}
+
+func TestRedacted(t *testing.T) {
+    c := HookConfig{
+        Hostname: "10.0.0.1",
+        Password: "hunter2",
+        WebhookSecret: "file:/home/ec2-user/.webhook_secret",
+        GitHubToken: "env:GITHUB_TOKEN",
+        ApiToken: "exec:pass las/api",
+        Tenants: map[string]TenantConfig{
+            "bob": {Password: "enc:abc", WebhookSecret: "bobs-secret"},
+        },
+    }
+    r := redacted(c)
+
+    want := HookConfig{
+        Hostname: "10.0.0.1",
+        Password: "<redacted>",
+        WebhookSecret: "file:/home/ec2-user/.webhook_secret",
+        GitHubToken: "env:GITHUB_TOKEN",
+        ApiToken: "<redacted>",
+        Tenants: map[string]TenantConfig{
+            "bob": {Password: "<redacted>", WebhookSecret: "<redacted>"},
+        },
+    }
+    if !reflect.DeepEqual(r, want) {
+        t.Fatalf("Redacted config is %+v, not %+v", r, want)
+    }
+
+    // The original, including its tenants, is left alone.
+    if c.Password != "hunter2" || c.Tenants["bob"].WebhookSecret != "bobs-secret" {
+        t.Fatalf("Original config was changed: %+v", c)
+    }
+}
+
+// checkConfigs checks that a demo config is valid and renders the Terraform
+// plan and Ansible playbook in testdata/<name>.tf and testdata/<name>.yml.
+func checkConfigs(t *testing.T, name string, dc DemoConfig) {
+    t.Helper()
+    checkErr(t, dc.IsValid(), "")
+
+    tf, err := terraformConfig(dc)
+    checkErr(t, err, "")
+    checkGolden(t, name + ".tf", tf)
+
+    yml, err := ansibleConfig(dc)
+    checkErr(t, err, "")
+    checkGolden(t, name + ".yml", yml)
+}
+
+func TestAppNames(t *testing.T) {
+    tests := []struct {
+        name string
+        apps []DemoService
+        err string
+    }{
+        {"valid", []DemoService{{Name: "web 1.0_a-b", Ports: []PortSpec{"80"}}}, ""},
+        {"longest", []DemoService{{Name: strings.Repeat("a", 57), Protocol: "both", Ports: []PortSpec{"53"}}}, ""},
+        {"too long", []DemoService{{Name: strings.Repeat("a", 58), Ports: []PortSpec{"80"}}}, "not a valid name"},
+        {"quotes and newlines", []DemoService{{Name: "x\"\n}\ndata \"external\" \"pwn\" {", Ports: []PortSpec{"80"}}}, "not a valid name"},
+        {"single quote", []DemoService{{Name: "it's", Ports: []PortSpec{"80"}}}, "not a valid name"},
+        {"duplicate", []DemoService{{Name: "web", Ports: []PortSpec{"80"}}, {Name: "web", Ports: []PortSpec{"443"}}}, "apps[0] has the same name"},
+        {"generated name taken", []DemoService{{Name: "dns", Protocol: "both", Ports: []PortSpec{"53"}}, {Name: "dns-tcp", Ports: []PortSpec{"54"}}}, `service "dns-tcp" would have the same name as one of apps[0]'s`},
+        {"generated name taken earlier", []DemoService{{Name: "dns-udp", Protocol: "udp", Ports: []PortSpec{"54"}}, {Name: "dns", Protocol: "both", Ports: []PortSpec{"53"}}}, `App "dns" (apps[1].name): service "dns-udp"`},
+    }
+
+    for _, tc := range tests {
+        t.Run(tc.name, func(t *testing.T) {
+            dc := DemoConfig{Method: "terraform", Services: tc.apps}
+            checkErr(t, dc.IsValid(), tc.err)
+        })
+    }
+}
+
+func TestProtocolConfigs(t *testing.T) {
+    checkConfigs(t, "protocols", DemoConfig{
+        Method: "terraform",
+        Services: []DemoService{
+            {Name: "ssh", Ports: []PortSpec{"22"}},
+            {Name: "syslog", Protocol: "udp", Ports: []PortSpec{"514"}},
+            {Name: "dns", Protocol: "both", Ports: []PortSpec{"53"}},
+        },
+    })
+}
+
+func TestProtocolValidation(t *testing.T) {
+    tests := []struct {
+        svc DemoService
+        err string
+    }{
+        {DemoService{Name: "ssh", Protocol: "tcp", Ports: []PortSpec{"22"}}, ""},
+        {DemoService{Name: "ping", Protocol: "icmp", Ports: []PortSpec{"7"}}, `invalid protocol "icmp"`},
+        {DemoService{Name: "ssh", Protocol: "TCP", Ports: []PortSpec{"22"}}, `invalid protocol "TCP"`},
+    }
+
+    for _, tc := range tests {
+        dc := DemoConfig{Method: "ansible", Services: []DemoService{tc.svc}}
+        checkErr(t, dc.IsValid(), tc.err)
+    }
+}
+
+func TestPortSpecParse(t *testing.T) {
+    tests := []struct {
+        spec PortSpec
+        want PortRange
+        err string
+    }{
+        {"443", PortRange{443, 443}, ""},
+        {" 80 ", PortRange{80, 80}, ""},
+        {"8000-8100", PortRange{8000, 8100}, ""},
+        {"1-65535", PortRange{1, 65535}, ""},
+        {"22-22", PortRange{22, 22}, ""},
+        {"0", PortRange{}, "is outside of 1-65535"},
+        {"70000", PortRange{}, "70000 is outside of 1-65535"},
+        {"100-65536", PortRange{}, "is outside of 1-65535"},
+        {"100-90", PortRange{}, "is backwards"},
+        {"http", PortRange{}, "is not a port or port range"},
+        {"1-2-3", PortRange{}, "is not a port or port range"},
+        {"", PortRange{}, "is not a port or port range"},
+    }
+
+    for _, tc := range tests {
+        t.Run(string(tc.spec), func(t *testing.T) {
+            r, err := tc.spec.Parse()
+            checkErr(t, err, tc.err)
+            if tc.err == "" && r != tc.want {
+                t.Fatalf("Parsed %s, not %s", r, tc.want)
+            }
+        })
+    }
+}
+
+func TestPortSpecUnmarshal(t *testing.T) {
+    var specs []PortSpec
+    if err := json.Unmarshal([]byte(`[80, "443", "8000-8100"]`), &specs); err != nil {
+        t.Fatal(err)
+    }
+
+    want := []PortSpec{"80", "443", "8000-8100"}
+    if !reflect.DeepEqual(specs, want) {
+        t.Fatalf("Got %q, not %q", specs, want)
+    }
+}
+
+func TestMergePorts(t *testing.T) {
+    tests := []struct {
+        name string
+        specs []PortSpec
+        want string
+    }{
+        {"none", nil, ""},
+        {"one", []PortSpec{"443"}, "443"},
+        {"sorted", []PortSpec{"443", "80"}, "80,443"},
+        {"adjacent", []PortSpec{"80", "81"}, "80-81"},
+        {"overlapping", []PortSpec{"8000-8100", "8050-8200"}, "8000-8200"},
+        {"contained", []PortSpec{"1-10", "3-4"}, "1-10"},
+        {"adjacent ranges", []PortSpec{"10-19", "20-29", "31"}, "10-29,31"},
+        {"invalid left out", []PortSpec{"ssh", "22"}, "22"},
+    }
+
+    for _, tc := range tests {
+        t.Run(tc.name, func(t *testing.T) {
+            if got := mergePorts(tc.specs); got != tc.want {
+                t.Fatalf("Got %q, not %q", got, tc.want)
+            }
+        })
+    }
+}
+
+func TestPortValidation(t *testing.T) {
+    tests := []struct {
+        name string
+        svc DemoService
+        err string
+    }{
+        {"ports", DemoService{Ports: []PortSpec{"80", "8000-8100"}}, ""},
+        {"tcp and udp", DemoService{TcpPorts: []PortSpec{"5061"}, UdpPorts: []PortSpec{"5060"}}, ""},
+        {"udp only", DemoService{UdpPorts: []PortSpec{"5060"}}, ""},
+        {"source ports", DemoService{Ports: []PortSpec{"123"}, SourcePorts: []PortSpec{"123"}}, ""},
+        {"no ports", DemoService{}, "no ports specified"},
+        {"source ports only", DemoService{SourcePorts: []PortSpec{"123"}}, "no ports specified"},
+        {"ports and tcp_ports", DemoService{Ports: []PortSpec{"80"}, TcpPorts: []PortSpec{"443"}}, `give either "ports" or "tcp_ports" and "udp_ports"`},
+        {"protocol with tcp_ports", DemoService{Protocol: "tcp", TcpPorts: []PortSpec{"443"}}, `"protocol" only applies to "ports"`},
+        {"out of range", DemoService{Ports: []PortSpec{"80", "443", "70000"}}, `App "web" (apps[0].ports[2]): 70000 is outside of 1-65535`},
+        {"bad source port", DemoService{Ports: []PortSpec{"80"}, SourcePorts: []PortSpec{"0"}}, "(apps[0].source_ports[0]): 0 is outside of 1-65535"},
+        {"repeated", DemoService{TcpPorts: []PortSpec{"443", "443"}}, "(apps[0].tcp_ports[1]): 443 is already given as tcp_ports[0]"},
+        {"repeated range", DemoService{UdpPorts: []PortSpec{"10-20", " 10-20"}}, "10-20 is already given as udp_ports[0]"},
+        {"application-default", DemoService{Service: ApplicationDefault, Applications: []string{"ssl"}}, ""},
+        {"application-default with ports", DemoService{Service: ApplicationDefault, Applications: []string{"ssl"}, Ports: []PortSpec{"443"}}, "ports can't be given with application-default"},
+        {"application-default with source ports", DemoService{Service: ApplicationDefault, Applications: []string{"ssl"}, SourcePorts: []PortSpec{"1024-65535"}}, "ports can't be given with application-default"},
+    }
+
+    for _, tc := range tests {
+        t.Run(tc.name, func(t *testing.T) {
+            tc.svc.Name = "web"
+            dc := DemoConfig{Method: "terraform", Services: []DemoService{tc.svc}}
+            checkErr(t, dc.IsValid(), tc.err)
+        })
+    }
+}
+
+func TestPortConfigs(t *testing.T) {
+    checkConfigs(t, "ports", DemoConfig{
+        Method: "ansible",
+        Services: []DemoService{
+            {Name: "web", Ports: []PortSpec{"443", "80", "81", "8000-8100", "8050-8200"}},
+            {Name: "ntp", Protocol: "udp", Ports: []PortSpec{"123"}, SourcePorts: []PortSpec{"123"}},
+            {Name: "sip", TcpPorts: []PortSpec{"5061"}, UdpPorts: []PortSpec{"5060"}, SourcePorts: []PortSpec{"1024-65535"}},
+            {Name: "tftp", UdpPorts: []PortSpec{"69"}},
+        },
+    })
+}
+
+func TestZoneConfigs(t *testing.T) {
+    checkConfigs(t, "zones", DemoConfig{
+        Method: "terraform",
+        Services: []DemoService{
+            {Name: "ssh", Ports: []PortSpec{"22"}, SourceAddresses: []string{"10.0.0.0/8", "192.168.1.1"}},
+            {Name: "outbound", Ports: []PortSpec{"443"}, SourceZones: []string{TrustZone}, DestinationZones: []string{UntrustZone, "dmz"}},
+            {Name: "not-lab", Ports: []PortSpec{"8080"}, SourceAddresses: []string{"10.1.0.0/16"}, NegateSource: true, DestinationAddresses: []string{"10.2.0.1-10.2.0.9"}, NegateDestination: true},
+        },
+    })
+}
+
+func TestZoneValidation(t *testing.T) {
+    tests := []struct {
+        name string
+        svc DemoService
+        err string
+    }{
+        {"zones", DemoService{SourceZones: []string{"dmz 1", "L3-trust"}}, ""},
+        {"bad zone", DemoService{DestinationZones: []string{"dmz", "a\"b"}}, `(apps[0].destination_zones[1]): "a\"b" is not a valid zone name`},
+        {"long zone", DemoService{SourceZones: []string{strings.Repeat("z", 32)}}, "is not a valid zone name"},
+        {"any address", DemoService{SourceAddresses: []string{"any"}}, ""},
+        {"any with others", DemoService{SourceAddresses: []string{"10.0.0.1", "any"}}, `(apps[0].source_addresses[1]): "any" can't be listed with other addresses`},
+        {"bad address", DemoService{DestinationAddresses: []string{"10.0.0.256"}}, "(apps[0].destination_addresses[0])"},
+        {"negate", DemoService{SourceAddresses: []string{"10.0.0.0/8"}, NegateSource: true}, ""},
+        {"negate nothing", DemoService{NegateSource: true}, `(apps[0].negate_source): only addresses other than "any" can be negated`},
+        {"negate any", DemoService{DestinationAddresses: []string{"any"}, NegateDestination: true}, "(apps[0].negate_destination)"},
+    }
+
+    for _, tc := range tests {
+        t.Run(tc.name, func(t *testing.T) {
+            tc.svc.Name = "web"
+            tc.svc.Ports = []PortSpec{"80"}
+            dc := DemoConfig{Method: "terraform", Services: []DemoService{tc.svc}}
+            checkErr(t, dc.IsValid(), tc.err)
+        })
+    }
+}
+
+func TestApplicationConfigs(t *testing.T) {
+    checkConfigs(t, "applications", DemoConfig{
+        Method: "terraform",
+        Services: []DemoService{
+            {Name: "ssh", Applications: []string{"ssh"}, Ports: []PortSpec{"22"}},
+            {Name: "intranet", Service: ApplicationDefault, Applications: []string{"web-browsing", "ssl"}},
+            {Name: "anything", Applications: []string{"any"}, Ports: []PortSpec{"8080"}},
+        },
+    })
+}
+
+func TestApplicationValidation(t *testing.T) {
+    known := map[string]bool{"ssh": true, "ssl": true, "web-browsing": true}
+    tests := []struct {
+        name string
+        svc DemoService
+        err string
+        known string
+    }{
+        {"custom", DemoService{Applications: []string{"ssh"}, Ports: []PortSpec{"22"}}, "", ""},
+        {"any", DemoService{Applications: []string{"any"}, Ports: []PortSpec{"22"}}, "", ""},
+        {"any with others", DemoService{Applications: []string{"ssh", "any"}, Ports: []PortSpec{"22"}}, `(apps[0].applications[1]): "any" can't be listed with other applications`, ""},
+        {"bad name", DemoService{Applications: []string{"ssh'"}, Ports: []PortSpec{"22"}}, `"ssh'" is not a valid application name`, ""},
+        {"unknown", DemoService{Applications: []string{"ssl", "web-browse"}, Ports: []PortSpec{"443"}}, "", `(apps[0].applications[1]): "web-browse" is not one of the firewall's predefined applications`},
+        {"application-default", DemoService{Service: ApplicationDefault, Applications: []string{"ssl"}}, "", ""},
+        {"application-default without applications", DemoService{Service: ApplicationDefault}, "application-default needs the applications to be listed", ""},
+        {"application-default with any", DemoService{Service: ApplicationDefault, Applications: []string{"any"}}, "application-default needs the applications to be listed", ""},
+        {"bad service", DemoService{Service: "default", Ports: []PortSpec{"22"}}, `invalid service "default"`, ""},
+    }
+
+    for _, tc := range tests {
+        t.Run(tc.name, func(t *testing.T) {
+            tc.svc.Name = "web"
+            dc := DemoConfig{Method: "ansible", Services: []DemoService{tc.svc}}
+            checkErr(t, dc.IsValid(), tc.err)
+            if tc.err == "" {
+                checkErr(t, dc.CheckApplications(known), tc.known)
+            }
+        })
+    }
+}
+
+func TestFirewallApplications(t *testing.T) {
+    // Only the names come back, as attributes of the entries.
+    list := predefinedApps{}
+    body := `<response status="success"><result total-count="2" count="2"><entry name="ssh"/><entry name="web-browsing"/></result></response>`
+    if err := xml.Unmarshal([]byte(body), &list); err != nil {
+        t.Fatal(err)
+    }
+    if len(list.Entries) != 2 || list.Entries[0].Name != "ssh" || list.Entries[1].Name != "web-browsing" {
+        t.Fatalf("Applications are %+v", list.Entries)
+    }
+
+    m := &FirewallMonitor{}
+    _, err := m.Applications()
+    checkErr(t, err, "Firewall is not ready")
+
+    // Fresh applications aren't fetched again.
+    m.status.Ready = true
+    m.apps, m.appsFetched = map[string]bool{"ssh": true}, time.Now()
+    apps, err := m.Applications()
+    checkErr(t, err, "")
+    if !reflect.DeepEqual(apps, m.apps) {
+        t.Fatalf("Applications are %v", apps)
+    }
+}
+
+func TestCheckAddresses(t *testing.T) {
+    tests := []struct {
+        name string
+        addrs []DemoAddress
+        groups []DemoAddressGroup
+        err string
+    }{
+        {"none", nil, nil, ""},
+        {"each type", []DemoAddress{{Name: "net", IpNetmask: "203.0.113.0/24"}, {Name: "host", IpNetmask: "2001:db8::1"}, {Name: "pool", IpRange: "10.0.0.10-10.0.0.20"}, {Name: "api", Fqdn: "api.example.com"}}, nil, ""},
+        {"static and dynamic groups", []DemoAddress{{Name: "a", IpNetmask: "10.0.0.1"}}, []DemoAddressGroup{{Name: "g", Static: []string{"a"}}, {Name: "gg", Static: []string{"g"}}, {Name: "d", Dynamic: "'web' and 'prod'"}}, ""},
+        {"no name", []DemoAddress{{IpNetmask: "10.0.0.1"}}, nil, "addresses[0].name: no name specified"},
+        {"name like an address", []DemoAddress{{Name: "10.0.0.1", IpNetmask: "10.0.0.1"}}, nil, "looks like an address"},
+        {"name any", []DemoAddress{{Name: "any", IpNetmask: "10.0.0.1"}}, nil, "looks like an address"},
+        {"bad name", []DemoAddress{{Name: "a'b", IpNetmask: "10.0.0.1"}}, nil, "is not a valid object name"},
+        {"duplicate", []DemoAddress{{Name: "a", IpNetmask: "10.0.0.1"}, {Name: "a", Fqdn: "a.example.com"}}, nil, `Address "a" (addresses[1].name): addresses[0] has the same name`},
+        {"two values", []DemoAddress{{Name: "a", IpNetmask: "10.0.0.1", Fqdn: "a.example.com"}}, nil, "give one of"},
+        {"no value", []DemoAddress{{Name: "a"}}, nil, "give one of"},
+        {"bad netmask", []DemoAddress{{Name: "a", IpNetmask: "10.0.0.0/33"}}, nil, "addresses[0].ip_netmask"},
+        {"range without dash", []DemoAddress{{Name: "a", IpRange: "10.0.0.1"}}, nil, "is not a range"},
+        {"backwards range", []DemoAddress{{Name: "a", IpRange: "10.0.0.20-10.0.0.1"}}, nil, "ends before it starts"},
+        {"mixed range", []DemoAddress{{Name: "a", IpRange: "10.0.0.1-::1"}}, nil, "is not a range of IPv4 or IPv6 addresses"},
+        {"bad fqdn", []DemoAddress{{Name: "a", Fqdn: "bad_host"}}, nil, "is not a valid FQDN"},
+        {"group named like an address", []DemoAddress{{Name: "a", IpNetmask: "10.0.0.1"}}, []DemoAddressGroup{{Name: "a", Static: []string{"a"}}}, `Address group "a" (address_groups[0].name): addresses[0] has the same name`},
+        {"empty group", nil, []DemoAddressGroup{{Name: "g"}}, "give either"},
+        {"static and dynamic", []DemoAddress{{Name: "a", IpNetmask: "10.0.0.1"}}, []DemoAddressGroup{{Name: "g", Static: []string{"a"}, Dynamic: "'web'"}}, "give either"},
+        {"unknown member", nil, []DemoAddressGroup{{Name: "g", Static: []string{"nope"}}}, "address_groups[0].static[0]"},
+        {"member listed later", nil, []DemoAddressGroup{{Name: "g", Static: []string{"h"}}, {Name: "h", Dynamic: "'web'"}}, "listed before this one"},
+        {"own member", nil, []DemoAddressGroup{{Name: "g", Static: []string{"g"}}}, "listed before this one"},
+        {"duplicate member", []DemoAddress{{Name: "a", IpNetmask: "10.0.0.1"}}, []DemoAddressGroup{{Name: "g", Static: []string{"a", "a"}}}, "is already given as static[0]"},
+        {"quoted filter", nil, []DemoAddressGroup{{Name: "g", Dynamic: `"web"`}}, "is not a valid tag filter"},
+    }
+
+    for _, tc := range tests {
+        t.Run(tc.name, func(t *testing.T) {
+            dc := DemoConfig{Addresses: tc.addrs, AddressGroups: tc.groups}
+            checkErr(t, dc.checkAddresses(), tc.err)
+        })
+    }
+}
+
+func TestAddressConfigs(t *testing.T) {
+    checkConfigs(t, "addresses", DemoConfig{
+        Method: "terraform",
+        Addresses: []DemoAddress{
+            {Name: "office", IpNetmask: "203.0.113.0/24"},
+            {Name: "pool", IpRange: "10.0.0.10-10.0.0.20"},
+            {Name: "api", Fqdn: "api.example.com"},
+        },
+        AddressGroups: []DemoAddressGroup{
+            {Name: "trusted", Static: []string{"office", "pool"}},
+            {Name: "prod-web", Dynamic: "'web' and 'prod'"},
+        },
+        Services: []DemoService{
+            {Name: "ssh", Ports: []PortSpec{"22"}, SourceAddresses: []string{"trusted", "198.51.100.7"}},
+            {Name: "web", Ports: []PortSpec{"443"}, SourceAddresses: []string{"office"}, NegateSource: true, DestinationAddresses: []string{"prod-web", "api"}},
+        },
+    })
+}
+
+func TestDiffAddresses(t *testing.T) {
+    before := &DemoConfig{
+        Addresses: []DemoAddress{{Name: "office", IpNetmask: "203.0.113.0/24"}, {Name: "old", Fqdn: "old.example.com"}},
+        AddressGroups: []DemoAddressGroup{{Name: "trusted", Static: []string{"office"}}},
+    }
+    after := &DemoConfig{
+        Addresses: []DemoAddress{{Name: "office", IpNetmask: "203.0.113.0/25"}, {Name: "new", IpRange: "10.0.0.1-10.0.0.9"}},
+        AddressGroups: []DemoAddressGroup{{Name: "trusted", Static: []string{"office"}}, {Name: "old", Dynamic: "'old'"}},
+    }
+
+    tests := []struct {
+        name string
+        before *DemoConfig
+        after *DemoConfig
+        want []string
+    }{
+        {"none", before, before, []string{}},
+        {"first plan", nil, before, []string{"added office", "added old", "added trusted"}},
+        {"all", before, after, []string{"changed office", "added new", "changed old"}},
+        {"removed", after, before, []string{"changed office", "changed old", "removed new"}},
+    }
+
+    for _, tc := range tests {
+        t.Run(tc.name, func(t *testing.T) {
+            got := make([]string, 0)
+            for _, c := range diffAddresses(tc.before, tc.after) {
+                got = append(got, c.Action + " " + c.Name)
+            }
+            if !reflect.DeepEqual(got, tc.want) {
+                t.Fatalf("Changes are %q, not %q", got, tc.want)
+            }
+        })
+    }
+}
+
+func TestAddressPlanComment(t *testing.T) {
+    base := &DemoConfig{
+        Method: "ansible",
+        Addresses: []DemoAddress{{Name: "office", IpNetmask: "203.0.113.0/24"}, {Name: "lab", IpNetmask: "10.9.0.0/16"}},
+        AddressGroups: []DemoAddressGroup{{Name: "trusted", Static: []string{"office"}}},
+        Services: []DemoService{
+            {Name: "ssh", Ports: []PortSpec{"22"}, SourceAddresses: []string{"trusted"}},
+            {Name: "lab", Ports: []PortSpec{"8080"}, SourceAddresses: []string{"lab"}},
+        },
+    }
+    demo := &DemoConfig{
+        Method: "ansible",
+        Addresses: []DemoAddress{{Name: "office", IpNetmask: "203.0.113.0/25"}, {Name: "api", Fqdn: "api.example.com"}},
+        AddressGroups: []DemoAddressGroup{{Name: "trusted", Static: []string{"office"}}},
+        Services: []DemoService{
+            {Name: "ssh", Ports: []PortSpec{"22"}, SourceAddresses: []string{"trusted"}},
+            {Name: "web", Ports: []PortSpec{"443"}, DestinationAddresses: []string{"api"}},
+        },
+    }
+
+    job := &Job{JobStatus: JobStatus{Sha: strings.Repeat("ab", 20), Method: "ansible", Stage: "plan"}}
+    checkGolden(t, "plan_addresses.md", planComment(job, base, demo, "", nil))
+}
@@ -0,0 +1,95 @@
+
+resource "panos_address_object" "ao0" {
+    name = "office"
+    description = "Corporate application address"
+    type = "ip-netmask"
+    value = "203.0.113.0/24"
+}
+
+resource "panos_address_object" "ao1" {
+    name = "pool"
+    description = "Corporate application address"
+    type = "ip-range"
+    value = "10.0.0.10-10.0.0.20"
+}
+
+resource "panos_address_object" "ao2" {
+    name = "api"
+    description = "Corporate application address"
+    type = "fqdn"
+    value = "api.example.com"
+}
+
+resource "panos_address_group" "ag0" {
+    name = "trusted"
+    description = "Corporate application addresses"
+    static_addresses = [panos_address_object.ao0.name, panos_address_object.ao1.name]
+}
+
+resource "panos_address_group" "ag1" {
+    name = "prod-web"
+    description = "Corporate application addresses"
+    dynamic_match = "'web' and 'prod'"
+}
+
+resource "panos_service_object" "so0" {
+    name = "ssh"
+    description = "Corporate application service"
+    protocol = "tcp"
+    destination_port = "22"
+}
+
+resource "panos_service_object" "so1" {
+    name = "web"
+    description = "Corporate application service"
+    protocol = "tcp"
+    destination_port = "443"
+}
+
+
+resource "panos_security_policies" "sec_rules"{
+
+    rule {
+        name = "Allow ssh"
+        source_zones = [panos_zone.zut.name]
+        source_addresses = [panos_address_group.ag0.name, "198.51.100.7"]
+        negate_source = false
+        source_users = ["any"]
+        hip_profiles = ["any"]
+        destination_zones = [panos_zone.zt.name]
+        destination_addresses = ["any"]
+        negate_destination = false
+        applications = ["any"]
+        services = [panos_service_object.so0.name]
+        categories = ["any"]
+        action = "allow"
+    }
+    rule {
+        name = "Allow web"
+        source_zones = [panos_zone.zut.name]
+        source_addresses = [panos_address_object.ao0.name]
+        negate_source = true
+        source_users = ["any"]
+        hip_profiles = ["any"]
+        destination_zones = [panos_zone.zt.name]
+        destination_addresses = [panos_address_group.ag1.name, panos_address_object.ao2.name]
+        negate_destination = false
+        applications = ["any"]
+        services = [panos_service_object.so1.name]
+        categories = ["any"]
+        action = "allow"
+    }
+    rule {
+        name = "Deny everything else"
+        source_zones = ["any"]
+        source_addresses = ["any"]
+        source_users = ["any"]
+        hip_profiles = ["any"]
+        destination_zones = ["any"]
+        destination_addresses = ["any"]
+        applications = ["any"]
+        services = ["application-default"]
+        categories = ["any"]
+        action = "deny"
+    }
+}
@@ -0,0 +1,77 @@
+
+resource "panos_service_object" "so0" {
+    name = "ssh"
+    description = "Corporate application service"
+    protocol = "tcp"
+    destination_port = "22"
+}
+
+resource "panos_service_object" "so2" {
+    name = "anything"
+    description = "Corporate application service"
+    protocol = "tcp"
+    destination_port = "8080"
+}
+
+
+resource "panos_security_policies" "sec_rules"{
+
+    rule {
+        name = "Allow ssh"
+        source_zones = [panos_zone.zut.name]
+        source_addresses = ["any"]
+        negate_source = false
+        source_users = ["any"]
+        hip_profiles = ["any"]
+        destination_zones = [panos_zone.zt.name]
+        destination_addresses = ["any"]
+        negate_destination = false
+        applications = ["ssh"]
+        services = [panos_service_object.so0.name]
+        categories = ["any"]
+        action = "allow"
+    }
+    rule {
+        name = "Allow intranet"
+        source_zones = [panos_zone.zut.name]
+        source_addresses = ["any"]
+        negate_source = false
+        source_users = ["any"]
+        hip_profiles = ["any"]
+        destination_zones = [panos_zone.zt.name]
+        destination_addresses = ["any"]
+        negate_destination = false
+        applications = ["web-browsing", "ssl"]
+        services = ["application-default"]
+        categories = ["any"]
+        action = "allow"
+    }
+    rule {
+        name = "Allow anything"
+        source_zones = [panos_zone.zut.name]
+        source_addresses = ["any"]
+        negate_source = false
+        source_users = ["any"]
+        hip_profiles = ["any"]
+        destination_zones = [panos_zone.zt.name]
+        destination_addresses = ["any"]
+        negate_destination = false
+        applications = ["any"]
+        services = [panos_service_object.so2.name]
+        categories = ["any"]
+        action = "allow"
+    }
+    rule {
+        name = "Deny everything else"
+        source_zones = ["any"]
+        source_addresses = ["any"]
+        source_users = ["any"]
+        hip_profiles = ["any"]
+        destination_zones = ["any"]
+        destination_addresses = ["any"]
+        applications = ["any"]
+        services = ["application-default"]
+        categories = ["any"]
+        action = "deny"
+    }
+}
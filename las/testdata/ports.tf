@@ -0,0 +1,121 @@
+
+resource "panos_service_object" "so0" {
+    name = "web"
+    description = "Corporate application service"
+    protocol = "tcp"
+    destination_port = "80-81,443,8000-8200"
+}
+
+resource "panos_service_object" "so1" {
+    name = "ntp"
+    description = "Corporate application service"
+    protocol = "udp"
+    source_port = "123"
+    destination_port = "123"
+}
+
+resource "panos_service_object" "so2_tcp" {
+    name = "sip-tcp"
+    description = "Corporate application service"
+    protocol = "tcp"
+    source_port = "1024-65535"
+    destination_port = "5061"
+}
+
+resource "panos_service_object" "so2_udp" {
+    name = "sip-udp"
+    description = "Corporate application service"
+    protocol = "udp"
+    source_port = "1024-65535"
+    destination_port = "5060"
+}
+
+resource "panos_service_group" "sg2" {
+    name = "sip"
+    services = [panos_service_object.so2_tcp.name, panos_service_object.so2_udp.name]
+}
+
+resource "panos_service_object" "so3" {
+    name = "tftp"
+    description = "Corporate application service"
+    protocol = "udp"
+    destination_port = "69"
+}
+
+
+resource "panos_security_policies" "sec_rules"{
+
+    rule {
+        name = "Allow web"
+        source_zones = [panos_zone.zut.name]
+        source_addresses = ["any"]
+        negate_source = false
+        source_users = ["any"]
+        hip_profiles = ["any"]
+        destination_zones = [panos_zone.zt.name]
+        destination_addresses = ["any"]
+        negate_destination = false
+        applications = ["any"]
+        services = [panos_service_object.so0.name]
+        categories = ["any"]
+        action = "allow"
+    }
+    rule {
+        name = "Allow ntp"
+        source_zones = [panos_zone.zut.name]
+        source_addresses = ["any"]
+        negate_source = false
+        source_users = ["any"]
+        hip_profiles = ["any"]
+        destination_zones = [panos_zone.zt.name]
+        destination_addresses = ["any"]
+        negate_destination = false
+        applications = ["any"]
+        services = [panos_service_object.so1.name]
+        categories = ["any"]
+        action = "allow"
+    }
+    rule {
+        name = "Allow sip"
+        source_zones = [panos_zone.zut.name]
+        source_addresses = ["any"]
+        negate_source = false
+        source_users = ["any"]
+        hip_profiles = ["any"]
+        destination_zones = [panos_zone.zt.name]
+        destination_addresses = ["any"]
+        negate_destination = false
+        applications = ["any"]
+        services = [panos_service_group.sg2.name]
+        categories = ["any"]
+        action = "allow"
+    }
+    rule {
+        name = "Allow tftp"
+        source_zones = [panos_zone.zut.name]
+        source_addresses = ["any"]
+        negate_source = false
+        source_users = ["any"]
+        hip_profiles = ["any"]
+        destination_zones = [panos_zone.zt.name]
+        destination_addresses = ["any"]
+        negate_destination = false
+        applications = ["any"]
+        services = [panos_service_object.so3.name]
+        categories = ["any"]
+        action = "allow"
+    }
+    rule {
+        name = "Deny everything else"
+        source_zones = ["any"]
+        source_addresses = ["any"]
+        source_users = ["any"]
+        hip_profiles = ["any"]
+        destination_zones = ["any"]
+        destination_addresses = ["any"]
+        applications = ["any"]
+        services = ["application-default"]
+        categories = ["any"]
+        action = "deny"
+    }
+}
@@ -0,0 +1,96 @@
+
+resource "panos_service_object" "so0" {
+    name = "ssh"
+    description = "Corporate application service"
+    protocol = "tcp"
+    destination_port = "22"
+}
+
+resource "panos_service_object" "so1" {
+    name = "syslog"
+    description = "Corporate application service"
+    protocol = "udp"
+    destination_port = "514"
+}
+
+resource "panos_service_object" "so2_tcp" {
+    name = "dns-tcp"
+    description = "Corporate application service"
+    protocol = "tcp"
+    destination_port = "53"
+}
+
+resource "panos_service_object" "so2_udp" {
+    name = "dns-udp"
+    description = "Corporate application service"
+    protocol = "udp"
+    destination_port = "53"
+}
+
+resource "panos_service_group" "sg2" {
+    name = "dns"
+    services = [panos_service_object.so2_tcp.name, panos_service_object.so2_udp.name]
+}
+
+
+resource "panos_security_policies" "sec_rules"{
+
+    rule {
+        name = "Allow ssh"
+        source_zones = [panos_zone.zut.name]
+        source_addresses = ["any"]
+        negate_source = false
+        source_users = ["any"]
+        hip_profiles = ["any"]
+        destination_zones = [panos_zone.zt.name]
+        destination_addresses = ["any"]
+        negate_destination = false
+        applications = ["any"]
+        services = [panos_service_object.so0.name]
+        categories = ["any"]
+        action = "allow"
+    }
+    rule {
+        name = "Allow syslog"
+        source_zones = [panos_zone.zut.name]
+        source_addresses = ["any"]
+        negate_source = false
+        source_users = ["any"]
+        hip_profiles = ["any"]
+        destination_zones = [panos_zone.zt.name]
+        destination_addresses = ["any"]
+        negate_destination = false
+        applications = ["any"]
+        services = [panos_service_object.so1.name]
+        categories = ["any"]
+        action = "allow"
+    }
+    rule {
+        name = "Allow dns"
+        source_zones = [panos_zone.zut.name]
+        source_addresses = ["any"]
+        negate_source = false
+        source_users = ["any"]
+        hip_profiles = ["any"]
+        destination_zones = [panos_zone.zt.name]
+        destination_addresses = ["any"]
+        negate_destination = false
+        applications = ["any"]
+        services = [panos_service_group.sg2.name]
+        categories = ["any"]
+        action = "allow"
+    }
+    rule {
+        name = "Deny everything else"
+        source_zones = ["any"]
+        source_addresses = ["any"]
+        source_users = ["any"]
+        hip_profiles = ["any"]
+        destination_zones = ["any"]
+        destination_addresses = ["any"]
+        applications = ["any"]
+        services = ["application-default"]
+        categories = ["any"]
+        action = "deny"
+    }
+}
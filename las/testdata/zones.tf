@@ -0,0 +1,84 @@
+
+resource "panos_service_object" "so0" {
+    name = "ssh"
+    description = "Corporate application service"
+    protocol = "tcp"
+    destination_port = "22"
+}
+
+resource "panos_service_object" "so1" {
+    name = "outbound"
+    description = "Corporate application service"
+    protocol = "tcp"
+    destination_port = "443"
+}
+
+resource "panos_service_object" "so2" {
+    name = "not-lab"
+    description = "Corporate application service"
+    protocol = "tcp"
+    destination_port = "8080"
+}
+
+
+resource "panos_security_policies" "sec_rules"{
+
+    rule {
+        name = "Allow ssh"
+        source_zones = [panos_zone.zut.name]
+        source_addresses = ["10.0.0.0/8", "192.168.1.1"]
+        negate_source = false
+        source_users = ["any"]
+        hip_profiles = ["any"]
+        destination_zones = [panos_zone.zt.name]
+        destination_addresses = ["any"]
+        negate_destination = false
+        applications = ["any"]
+        services = [panos_service_object.so0.name]
+        categories = ["any"]
+        action = "allow"
+    }
+    rule {
+        name = "Allow outbound"
+        source_zones = [panos_zone.zt.name]
+        source_addresses = ["any"]
+        negate_source = false
+        source_users = ["any"]
+        hip_profiles = ["any"]
+        destination_zones = [panos_zone.zut.name, "dmz"]
+        destination_addresses = ["any"]
+        negate_destination = false
+        applications = ["any"]
+        services = [panos_service_object.so1.name]
+        categories = ["any"]
+        action = "allow"
+    }
+    rule {
+        name = "Allow not-lab"
+        source_zones = [panos_zone.zut.name]
+        source_addresses = ["10.1.0.0/16"]
+        negate_source = true
+        source_users = ["any"]
+        hip_profiles = ["any"]
+        destination_zones = [panos_zone.zt.name]
+        destination_addresses = ["10.2.0.1-10.2.0.9"]
+        negate_destination = true
+        applications = ["any"]
+        services = [panos_service_object.so2.name]
+        categories = ["any"]
+        action = "allow"
+    }
+    rule {
+        name = "Deny everything else"
+        source_zones = ["any"]
+        source_addresses = ["any"]
+        source_users = ["any"]
+        hip_profiles = ["any"]
+        destination_zones = ["any"]
+        destination_addresses = ["any"]
+        applications = ["any"]
+        services = ["application-default"]
+        categories = ["any"]
+        action = "deny"
+    }
+}
@@ -31,6 +31,16 @@ resource "random_string" "sgName" {
     special = false
 }
 
+resource "random_string" "hookSecret" {
+    length = 32
+    special = false
+}
+
+resource "random_string" "apiToken" {
+    length = 32
+    special = false
+}
+
 resource "aws_security_group" "sg" {
     name = random_string.sgName.result
     description = "cloud automation demo sg"
@@ -91,12 +101,24 @@ resource "aws_instance" "linux" {
 echo "Starting user data config initialization"
 cd /home/ec2-user
 echo "Saving panos info"
+(umask 077 && echo '${local.password}' > .panos_password)
+echo "Saving listener secrets"
+(umask 077 && echo '${random_string.hookSecret.result}' > .webhook_secret)
+(umask 077 && echo '${var.github_token}' > .github_token)
+(umask 077 && echo '${random_string.apiToken.result}' > .api_token)
+umask 077
 echo '{' > config.json
 echo '  "github_account": "${var.github_account}",' >> config.json
+echo '  "webhook_secret": "file:/home/ec2-user/.webhook_secret",' >> config.json
+echo '  "github_token": "file:/home/ec2-user/.github_token",' >> config.json
+echo '  "api_token": "file:/home/ec2-user/.api_token",' >> config.json
+echo '  "tls_self_signed": true,' >> config.json
+echo "  \"public_url\": \"https://$(curl -s http://169.254.169.254/latest/meta-data/public-ipv4):8080\"," >> config.json
 echo '  "hostname": "${aws_instance.panos.public_ip}",' >> config.json
 echo '  "username": "${var.panos_username}",' >> config.json
-echo '  "password": "${local.password}"' >> config.json
+echo '  "password": "file:/home/ec2-user/.panos_password"' >> config.json
 echo '}' >> config.json
+umask 022
 echo "Making required directories ..."
 mkdir bin
 mkdir anchor
@@ -106,18 +128,19 @@ mkdir golang/bin
 mkdir golang/src
 echo "Updating .bash_profile ..."
 echo 'export GOPATH=/home/ec2-user/golang' >> /home/ec2-user/.bash_profile
+echo 'export GO111MODULE=off' >> /home/ec2-user/.bash_profile
 echo 'export GOBIN=/home/ec2-user/golang/bin' >> /home/ec2-user/.bash_profile
 echo 'export PANOS_HOSTNAME=${aws_instance.panos.public_ip}' >> /home/ec2-user/.bash_profile
 echo 'export PANOS_USERNAME=${var.panos_username}' >> /home/ec2-user/.bash_profile
-echo 'export PANOS_PASSWORD="${local.password}"' >> /home/ec2-user/.bash_profile
+echo 'export PANOS_PASSWORD="$(cat /home/ec2-user/.panos_password)"' >> /home/ec2-user/.bash_profile
 echo "alias s='cd ..'" >> /home/ec2-user/.bash_profile
 echo "alias la='ls -laF'" >> /home/ec2-user/.bash_profile
-echo "alias wl='tail -f /tmp/hook.log'" >> /home/ec2-user/.bash_profile
+echo "alias wl='tail -F /tmp/hook.log'" >> /home/ec2-user/.bash_profile
 echo "Updating yum and installing golang ..."
 yum update -y
 yum install -y golang
 echo "Retrieving pango ..."
-GOPATH=/home/ec2-user/golang go get github.com/PaloAltoNetworks/pango
+GO111MODULE=off GOPATH=/home/ec2-user/golang go get github.com/PaloAltoNetworks/pango
 echo "Pulling down ${var.github_account}'s HookOrg repo ..."
 git clone "https://github.com/HookOrg/${var.github_account}.git"
 echo "Pulling down the cloud demo repo ..."
@@ -128,9 +151,9 @@ echo "Ansible: install and prep ..."
 pip install pan-python pandevice xmltodict ansible
 /usr/local/bin/ansible-galaxy install PaloAltoNetworks.paloaltonetworks
 echo "provider:" > anchor/vars.yml
-echo "    ip_address: '${aws_instance.panos.public_ip}'" >> anchor/vars.yml
-echo "    username: '${var.panos_username}'" >> anchor/vars.yml
-echo "    password: '${local.password}'" >> anchor/vars.yml
+echo "    ip_address: \"{{ lookup('env', 'PANOS_HOSTNAME') }}\"" >> anchor/vars.yml
+echo "    username: \"{{ lookup('env', 'PANOS_USERNAME') }}\"" >> anchor/vars.yml
+echo "    password: \"{{ lookup('env', 'PANOS_PASSWORD') }}\"" >> anchor/vars.yml
 touch anchor/deploy.retry
 echo "[fw]" > anchor/hosts
 echo "${aws_instance.panos.public_ip} ansible_python_interpreter=python" >> anchor/hosts
@@ -145,9 +168,9 @@ rm -f tf.zip
 cd ..
 echo "Building webhook listener ..."
 touch /tmp/hook.log
-HOME=/home/ec2-user GOPATH=/home/ec2-user/golang go build -o /home/ec2-user/bin/las /home/ec2-user/cloud-automation-demo/las.go
+HOME=/home/ec2-user GO111MODULE=off GOPATH=/home/ec2-user/golang go build -o /home/ec2-user/bin/las /home/ec2-user/cloud-automation-demo/las
 echo "Building commit binary ..."
-HOME=/home/ec2-user GOPATH=/home/ec2-user/golang go build -o /home/ec2-user/bin/commit /home/ec2-user/cloud-automation-demo/commit.go
+HOME=/home/ec2-user GO111MODULE=off GOPATH=/home/ec2-user/golang go build -o /home/ec2-user/bin/commit /home/ec2-user/cloud-automation-demo/commit.go
 echo "Fixing all permissions ..."
 chown -R ec2-user:ec2-user /home/ec2-user
 chown ec2-user:ec2-user /tmp/hook.log
@@ -165,10 +188,12 @@ provider "github" {
 
 resource "github_repository_webhook" "hook" {
     repository = var.github_account
-    events = ["push"]
+    events = ["push", "pull_request"]
     configuration {
-        url = "http://${aws_instance.linux.public_ip}:8080/"
+        url = "https://${aws_instance.linux.public_ip}:8080/"
         content_type = "json"
+        insecure_ssl = true
+        secret = random_string.hookSecret.result
     }
 }
 
@@ -182,6 +207,25 @@ resource "null_resource" "fwinit" {
     }
 }
 
+resource "null_resource" "lasready" {
+    depends_on = [null_resource.fwinit]
+
+    triggers = {
+        key = aws_instance.linux.public_ip
+    }
+
+    provisioner "local-exec" {
+        command = <<READY
+for i in $(seq 90); do
+    curl -sfk https://${aws_instance.linux.public_ip}:8080/readyz && exit 0
+    sleep 10
+done
+echo "The webhook listener on ${aws_instance.linux.public_ip} wasn't ready after 15 minutes; see /tmp/hook.log there" >&2
+exit 1
+READY
+    }
+}
+
 
 output "panos_ip" {
     value = aws_instance.panos.public_ip
@@ -191,6 +235,10 @@ output "panos_password" {
     value = local.password
 }
 
+output "api_token" {
+    value = random_string.apiToken.result
+}
+
 output "linux_ip" {
     value = aws_instance.linux.public_ip
 }